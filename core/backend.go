@@ -0,0 +1,376 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BalanceRoundRobin = "rr"
+	BalanceLeastConns = "lc"
+	BalanceHash       = "hash" // consistent hash by source ip.
+)
+
+type BackendPoolOpts struct {
+	// Policy is the backend selection policy. BalanceRoundRobin (default),
+	// BalanceLeastConns or BalanceHash.
+	Policy string
+	// HealthCheckInterval is the interval of active tcp health checks.
+	// Zero disables active health checks.
+	HealthCheckInterval time.Duration
+	// MaxFails consecutive dial failures eject a backend for EjectTime.
+	// Default is 3 and 30s.
+	MaxFails  int
+	EjectTime time.Duration
+	// DialTimeout is the total timeout of dialing, including the retries
+	// of other backends. Default is 5s.
+	DialTimeout time.Duration
+	// SRVRefresh is the interval to refresh SRV records. Default is 1m.
+	SRVRefresh time.Duration
+	// SocketOpts is applied to the sockets of backends. It is validated by
+	// NewBackendPool.
+	SocketOpts *TcpConfig
+	// Logger default is the global logger from mlog.
+	Logger *zap.Logger
+}
+
+// IsBackendPool reports whether dst is a backend pool spec, see NewBackendPool.
+func IsBackendPool(dst string) bool {
+	return strings.Contains(dst, "|") || strings.HasPrefix(dst, "srv:")
+}
+
+// BackendPool is a pool of tcp backends. It is safe for concurrent use.
+type BackendPool struct {
+	opts   BackendPoolOpts
+	logger *zap.Logger
+
+	static   []string
+	srvNames []string
+
+	m        sync.Mutex
+	backends []*backend
+	rr       uint32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type backend struct {
+	addr    string
+	fromSRV string // the SRV name, empty if it is a static backend.
+	active  int32  // atomic, active conns.
+
+	m            sync.Mutex
+	fails        int
+	ejectedUntil time.Time
+	unhealthy    bool // by active health checks.
+}
+
+func (b *backend) usable(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return !b.unhealthy && !now.Before(b.ejectedUntil)
+}
+
+// NewBackendPool returns a BackendPool from spec. spec is a '|' separated
+// list of backends. A backend can be "host:port", a unix socket
+// "unix:/path", or "srv:name" whose backends are discovered from the DNS
+// SRV records of name, e.g. "srv:_http._tcp.example.com".
+// BackendPool.Close must be called to stop its background goroutine.
+func NewBackendPool(spec string, opts BackendPoolOpts) (*BackendPool, error) {
+	switch opts.Policy {
+	case "":
+		opts.Policy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConns, BalanceHash:
+	default:
+		return nil, fmt.Errorf("unknown balance policy [%s]", opts.Policy)
+	}
+	if opts.MaxFails <= 0 {
+		opts.MaxFails = 3
+	}
+	if opts.EjectTime <= 0 {
+		opts.EjectTime = time.Second * 30
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = time.Second * 5
+	}
+	if opts.SRVRefresh <= 0 {
+		opts.SRVRefresh = time.Minute
+	}
+	if err := opts.SocketOpts.validate(); err != nil {
+		return nil, err
+	}
+
+	p := &BackendPool{opts: opts, stop: make(chan struct{})}
+	p.logger = newConnLogger(opts.Logger, "").l.With(zap.String("backends", spec))
+	for _, e := range strings.Split(spec, "|") {
+		e = strings.TrimSpace(e)
+		switch {
+		case len(e) == 0:
+		case strings.HasPrefix(e, "srv:"):
+			p.srvNames = append(p.srvNames, strings.TrimPrefix(e, "srv:"))
+		case strings.HasPrefix(e, unixAddrPrefix):
+			p.static = append(p.static, e)
+		default:
+			if _, _, err := net.SplitHostPort(e); err != nil {
+				return nil, fmt.Errorf("invalid backend [%s]: %w", e, err)
+			}
+			p.static = append(p.static, e)
+		}
+	}
+	if len(p.static) == 0 && len(p.srvNames) == 0 {
+		return nil, fmt.Errorf("no backend in [%s]", spec)
+	}
+	p.refreshSRV()
+	go p.loop()
+	return p, nil
+}
+
+// Close stops the health checks and the SRV refresh.
+func (p *BackendPool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+var errNoBackend = errors.New("no backend available")
+
+// Dial dials a backend selected by the policy. If it fails, the next
+// backend will be tried until DialTimeout. key is the source ip for
+// BalanceHash.
+func (p *BackendPool) Dial(ctx context.Context, key string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.DialTimeout)
+	defer cancel()
+
+	candidates := p.candidates(key)
+	if len(candidates) == 0 {
+		return nil, errNoBackend
+	}
+	d := p.opts.SocketOpts.newDialer(0)
+	var lastErr error
+	for i, b := range candidates {
+		// Share the remaining time between the remaining backends.
+		deadline, _ := ctx.Deadline()
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(candidates)-i))
+		network, addr := splitAddr(b.addr)
+		c, err := d.DialContext(attemptCtx, network, addr)
+		attemptCancel()
+		if err == nil {
+			p.dialOK(b)
+			atomic.AddInt32(&b.active, 1)
+			return &backendConn{Conn: c, b: b}, nil
+		}
+		lastErr = err
+		p.dialFailed(b, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// candidates returns usable backends in the order of the policy. If
+// no backend is usable, all backends are returned.
+func (p *BackendPool) candidates(key string) []*backend {
+	p.m.Lock()
+	all := p.backends
+	p.m.Unlock()
+
+	now := time.Now()
+	bs := make([]*backend, 0, len(all))
+	for _, b := range all {
+		if b.usable(now) {
+			bs = append(bs, b)
+		}
+	}
+	if len(bs) == 0 {
+		bs = append(bs, all...)
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+
+	switch p.opts.Policy {
+	case BalanceLeastConns:
+		sort.SliceStable(bs, func(i, j int) bool {
+			return atomic.LoadInt32(&bs[i].active) < atomic.LoadInt32(&bs[j].active)
+		})
+	case BalanceHash:
+		// Rendezvous hashing. Only keys of a removed backend are moved.
+		score := func(b *backend) uint64 {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte(b.addr))
+			return h.Sum64()
+		}
+		sort.Slice(bs, func(i, j int) bool { return score(bs[i]) > score(bs[j]) })
+	default:
+		n := int(atomic.AddUint32(&p.rr, 1)) % len(bs)
+		bs = append(bs[n:], bs[:n]...)
+	}
+	return bs
+}
+
+func (p *BackendPool) dialOK(b *backend) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.fails = 0
+}
+
+func (p *BackendPool) dialFailed(b *backend, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.fails++
+	if b.fails >= p.opts.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.opts.EjectTime)
+		p.logger.Warn("backend ejected", zap.String("backend", b.addr), zap.Duration("eject_time", p.opts.EjectTime), zap.Error(err))
+	}
+}
+
+func (p *BackendPool) loop() {
+	var healthC, srvC <-chan time.Time
+	if p.opts.HealthCheckInterval > 0 {
+		t := time.NewTicker(p.opts.HealthCheckInterval)
+		defer t.Stop()
+		healthC = t.C
+	}
+	if len(p.srvNames) > 0 {
+		t := time.NewTicker(p.opts.SRVRefresh)
+		defer t.Stop()
+		srvC = t.C
+	}
+	for {
+		select {
+		case <-healthC:
+			p.healthCheck()
+		case <-srvC:
+			p.refreshSRV()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// healthCheck dials all backends and updates their health status.
+func (p *BackendPool) healthCheck() {
+	p.m.Lock()
+	bs := p.backends
+	p.m.Unlock()
+
+	timeout := p.opts.HealthCheckInterval
+	if timeout > p.opts.DialTimeout {
+		timeout = p.opts.DialTimeout
+	}
+	wg := new(sync.WaitGroup)
+	for _, b := range bs {
+		b := b
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			network, addr := splitAddr(b.addr)
+			c, err := p.opts.SocketOpts.newDialer(timeout).Dial(network, addr)
+			if err == nil {
+				c.Close()
+			}
+			b.m.Lock()
+			changed := b.unhealthy != (err != nil)
+			b.unhealthy = err != nil
+			b.m.Unlock()
+			if changed {
+				p.logger.Info("backend health changed", zap.String("backend", b.addr), zap.Bool("healthy", err == nil), zap.NamedError("check_err", err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// refreshSRV rebuilds the backend list from static backends and SRV
+// records. The status of existing backends is kept. If a lookup fails,
+// its previous backends are kept.
+func (p *BackendPool) refreshSRV() {
+	p.m.Lock()
+	old := make(map[string]*backend, len(p.backends))
+	for _, b := range p.backends {
+		old[b.addr] = b
+	}
+	p.m.Unlock()
+
+	addrs := append([]string(nil), p.static...)
+	for _, name := range p.srvNames {
+		_, srvs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			p.logger.Warn("failed to lookup srv", zap.String("name", name), zap.Error(err))
+			for addr, b := range old {
+				if b.fromSRV == name {
+					addrs = append(addrs, addr)
+				}
+			}
+			continue
+		}
+		for _, srv := range srvs {
+			addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+			addrs = append(addrs, addr)
+			if old[addr] == nil {
+				old[addr] = &backend{addr: addr, fromSRV: name}
+			}
+		}
+	}
+
+	bs := make([]*backend, 0, len(addrs))
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		b := old[addr]
+		if b == nil {
+			b = &backend{addr: addr}
+		}
+		bs = append(bs, b)
+	}
+	p.m.Lock()
+	p.backends = bs
+	p.m.Unlock()
+}
+
+// backendConn decreases the active conns of its backend when it is closed.
+type backendConn struct {
+	net.Conn
+	b         *backend
+	closeOnce sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt32(&c.b.active, -1) })
+	return c.Conn.Close()
+}
+
+func (c *backendConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,94 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_BackendPool(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l := startEchoServer(t)
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	spec := dead.Addr().String() + "|" + addrs[0] + "|" + addrs[1]
+
+	dial := func(p *BackendPool, key string) string {
+		c, err := p.Dial(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.RemoteAddr().String()
+	}
+
+	t.Run("rr", func(t *testing.T) {
+		p, err := NewBackendPool(spec, BackendPoolOpts{MaxFails: 1, EjectTime: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		used := make(map[string]int)
+		for i := 0; i < 10; i++ {
+			used[dial(p, "")]++
+		}
+		// The dead one was retried and ejected.
+		if len(used) != 2 || used[addrs[0]] < 4 || used[addrs[1]] < 4 {
+			t.Fatalf("unbalanced %v", used)
+		}
+		if p.backends[0].usable(time.Now()) {
+			t.Fatal("the dead backend should be ejected")
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		p, err := NewBackendPool(addrs[0]+"|"+addrs[1], BackendPoolOpts{Policy: BalanceHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		want := dial(p, "192.0.2.1")
+		for i := 0; i < 5; i++ {
+			if got := dial(p, "192.0.2.1"); got != want {
+				t.Fatalf("same key got different backends %s %s", want, got)
+			}
+		}
+	})
+
+	t.Run("health_check", func(t *testing.T) {
+		p, err := NewBackendPool(spec, BackendPoolOpts{HealthCheckInterval: time.Millisecond * 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		time.Sleep(time.Millisecond * 100)
+		if p.backends[0].usable(time.Now()) || !p.backends[1].usable(time.Now()) {
+			t.Fatal("invalid health status")
+		}
+	})
+}
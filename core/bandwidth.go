@@ -0,0 +1,234 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"github.com/IrineSistiana/simple-tls/core/mlog"
+	"github.com/IrineSistiana/simple-tls/core/ratelimit"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+// BandwidthLimit is the token bucket config of a bandwidth limit.
+type BandwidthLimit struct {
+	Rate  float64 // bytes per second. <= 0 means unlimited.
+	Burst int     // bytes. <= 0 means Rate.
+}
+
+type BandwidthLimiterOpts struct {
+	// Global limits all tunnels. PerKey limits tunnels that have the same
+	// key. PerTunnel limits every single tunnel. Bytes of both directions
+	// are counted.
+	Global, PerKey, PerTunnel BandwidthLimit
+
+	// Key returns the identity of a tunnel. Default is the source IP.
+	Key func(ctx context.Context, conn net.Conn) string
+
+	// Logger logs the bandwidth usage every LogInterval (default 1m)
+	// while there are active tunnels. Default is the global logger from mlog.
+	Logger      *zap.Logger
+	LogInterval time.Duration
+}
+
+// BandwidthLimiter limits the bandwidth of tunnels at three levels: global,
+// per key (source IP by default) and per tunnel. The bandwidth of a parent
+// level is shared fairly between its busy children.
+// Limits are applied to tunnels opened by DstTransportHandler, use
+// BandwidthLimiter.Middleware to install it.
+type BandwidthLimiter struct {
+	opts   BandwidthLimiterOpts
+	global *ratelimit.Limiter
+
+	m         sync.Mutex
+	perKey    BandwidthLimit
+	perTunnel BandwidthLimit
+	keys      map[string]*keyLimiter
+	tunnels   map[*ratelimit.Limiter]struct{}
+	logStop   chan struct{} // nil if the usage logger is not running.
+}
+
+type keyLimiter struct {
+	l       *ratelimit.Limiter
+	tunnels int
+}
+
+func NewBandwidthLimiter(opts BandwidthLimiterOpts) *BandwidthLimiter {
+	if opts.Key == nil {
+		opts.Key = func(_ context.Context, conn net.Conn) string {
+			return remoteIP(conn.RemoteAddr())
+		}
+	}
+	if opts.Logger == nil {
+		opts.Logger = mlog.L()
+	}
+	if opts.LogInterval <= 0 {
+		opts.LogInterval = time.Minute
+	}
+	return &BandwidthLimiter{
+		opts:      opts,
+		global:    ratelimit.NewLimiter(nil, opts.Global.Rate, opts.Global.Burst),
+		perKey:    opts.PerKey,
+		perTunnel: opts.PerTunnel,
+		keys:      make(map[string]*keyLimiter),
+		tunnels:   make(map[*ratelimit.Limiter]struct{}),
+	}
+}
+
+// SetLimits changes the limits at runtime. Active tunnels are also affected.
+func (bl *BandwidthLimiter) SetLimits(global, perKey, perTunnel BandwidthLimit) {
+	bl.global.SetLimit(global.Rate, global.Burst)
+
+	bl.m.Lock()
+	defer bl.m.Unlock()
+	bl.perKey = perKey
+	bl.perTunnel = perTunnel
+	for _, k := range bl.keys {
+		k.l.SetLimit(perKey.Rate, perKey.Burst)
+	}
+	for l := range bl.tunnels {
+		l.SetLimit(perTunnel.Rate, perTunnel.Burst)
+	}
+}
+
+// Middleware returns a Middleware that applies bl to tunnels.
+func (bl *BandwidthLimiter) Middleware() Middleware {
+	return func(next TransportHandler) TransportHandler {
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			key := bl.opts.Key(ctx, conn)
+			l := bl.open(key)
+			defer bl.release(key, l)
+			return next.Handle(withTunnelLimiter(ctx, l), conn)
+		})
+	}
+}
+
+// open returns a new tunnel limiter under the limiter of key.
+func (bl *BandwidthLimiter) open(key string) *ratelimit.Limiter {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+
+	k := bl.keys[key]
+	if k == nil {
+		k = &keyLimiter{l: ratelimit.NewLimiter(bl.global, bl.perKey.Rate, bl.perKey.Burst)}
+		bl.keys[key] = k
+	}
+	k.tunnels++
+	l := ratelimit.NewLimiter(k.l, bl.perTunnel.Rate, bl.perTunnel.Burst)
+	bl.tunnels[l] = struct{}{}
+
+	if bl.logStop == nil {
+		bl.logStop = make(chan struct{})
+		go bl.logUsage(bl.logStop)
+	}
+	return l
+}
+
+func (bl *BandwidthLimiter) release(key string, l *ratelimit.Limiter) {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+
+	delete(bl.tunnels, l)
+	if k := bl.keys[key]; k != nil {
+		k.tunnels--
+		if k.tunnels <= 0 {
+			delete(bl.keys, key)
+		}
+	}
+	if len(bl.tunnels) == 0 && bl.logStop != nil {
+		close(bl.logStop)
+		bl.logStop = nil
+	}
+}
+
+// logUsage logs the usage of bl periodically until stop is closed.
+func (bl *BandwidthLimiter) logUsage(stop chan struct{}) {
+	ticker := time.NewTicker(bl.opts.LogInterval)
+	defer ticker.Stop()
+
+	lastGlobal := bl.global.Total()
+	lastKeys := make(map[string]int64)
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		sec := bl.opts.LogInterval.Seconds()
+
+		bl.m.Lock()
+		keyUsage := make(map[string]int64, len(bl.keys))
+		for key, k := range bl.keys {
+			keyUsage[key] = k.l.Total()
+		}
+		tunnels := len(bl.tunnels)
+		bl.m.Unlock()
+
+		total := bl.global.Total()
+		bl.opts.Logger.Info("bandwidth usage",
+			zap.Float64("global_bps", float64(total-lastGlobal)/sec),
+			zap.Int("keys", len(keyUsage)),
+			zap.Int("tunnels", tunnels),
+		)
+		lastGlobal = total
+		for key, t := range keyUsage {
+			last := lastKeys[key]
+			if last > t { // The key limiter was re-created.
+				last = 0
+			}
+			bl.opts.Logger.Debug("bandwidth usage of key", zap.String("key", key), zap.Float64("bps", float64(t-last)/sec))
+		}
+		lastKeys = keyUsage
+	}
+}
+
+type tunnelLimiterCtxKey struct{}
+
+func withTunnelLimiter(ctx context.Context, l *ratelimit.Limiter) context.Context {
+	return context.WithValue(ctx, tunnelLimiterCtxKey{}, l)
+}
+
+func tunnelLimiterFromContext(ctx context.Context) *ratelimit.Limiter {
+	l, _ := ctx.Value(tunnelLimiterCtxKey{}).(*ratelimit.Limiter)
+	return l
+}
+
+// remoteIP returns the ip of addr. If addr has no port, it returns
+// addr.String().
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// peerIP returns the ip of addr. ok is false if addr is not an ip
+// address, e.g. a unix socket peer.
+func peerIP(addr net.Addr) (ip string, ok bool) {
+	if addr == nil {
+		return "", false
+	}
+	ip = remoteIP(addr)
+	return ip, net.ParseIP(ip) != nil
+}
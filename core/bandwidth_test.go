@@ -0,0 +1,99 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_BandwidthLimiter(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	// echo sends n bytes through a tunnel of s and reads them back. Both
+	// directions are counted by the limiter, so 2n bytes are consumed.
+	echo := func(serverAddr string, n int) error {
+		conn, err := tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		b := make([]byte, n)
+		rand.Read(b)
+		go conn.Write(b)
+		_, err = io.ReadFull(conn, b)
+		return err
+	}
+	start := func(t *testing.T, opts BandwidthLimiterOpts) string {
+		addr, _ := startTestServer(t, &Server{
+			DstAddr:     echoListener.Addr().String(),
+			IdleTimeout: time.Minute,
+			Middlewares: []Middleware{NewBandwidthLimiter(opts).Middleware()},
+		})
+		return addr
+	}
+
+	const rate = 256 * 1024
+	limit := BandwidthLimit{Rate: rate, Burst: 16 * 1024}
+	// A tunnel that sends rate/2 bytes (rate bytes counted) takes about 1s
+	// at the full rate, and about 2s if it only gets half of the rate.
+	const n = rate / 2
+
+	t.Run("per_tunnel", func(t *testing.T) {
+		serverAddr := start(t, BandwidthLimiterOpts{PerTunnel: limit})
+		begin := time.Now()
+		if err := echo(serverAddr, n); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(begin); d < time.Millisecond*700 {
+			t.Fatalf("tunnel was not limited, took %v", d)
+		}
+	})
+
+	t.Run("per_key_shared", func(t *testing.T) {
+		// Two tunnels from the same ip share one key limit. Each of them
+		// is also limited by PerTunnel, which alone would allow the full rate.
+		serverAddr := start(t, BandwidthLimiterOpts{PerKey: limit, PerTunnel: limit})
+		begin := time.Now()
+		wg := new(sync.WaitGroup)
+		elapsed := make([]time.Duration, 2)
+		for i := range elapsed {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := echo(serverAddr, n); err != nil {
+					t.Error(err)
+				}
+				elapsed[i] = time.Since(begin)
+			}()
+		}
+		wg.Wait()
+		for i, d := range elapsed {
+			if d < time.Millisecond*1500 {
+				t.Fatalf("tunnel %d did not share the key limit, took %v", i, d)
+			}
+		}
+	})
+}
@@ -0,0 +1,255 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type BanListOpts struct {
+	// MaxFailures is the number of failures within Window that triggers
+	// a ban. Default is 5.
+	MaxFailures int
+	// Window default is 1m.
+	Window time.Duration
+	// BanTime is the duration of the first ban. Default is 10m. It doubles
+	// for every following ban of the same IP, up to MaxBanTime (default 24h).
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+	// File is the path to persist the bans. Empty means no persistence.
+	File string
+	// Logger logs bans. Default is the global logger from mlog.
+	Logger *zap.Logger
+}
+
+// BanList bans source IPs that failed too many times, like fail2ban.
+// Failures are reported by the Server (tls handshake failures, unknown
+// grpc paths) and by users via Fail. Use BanList.Listener to drop
+// banned peers.
+// It is safe for concurrent use.
+type BanList struct {
+	opts   BanListOpts
+	logger connLogger
+	now    func() time.Time
+
+	m         sync.Mutex
+	peers     map[string]*banEntry
+	lastSweep time.Time
+	saveM     sync.Mutex // serializes save.
+}
+
+type banEntry struct {
+	Until time.Time `json:"until"`
+	Bans  int       `json:"bans"` // number of bans, for the exponential growth.
+
+	failures    int
+	windowStart time.Time
+}
+
+// NewBanList returns a BanList. If opts.File exists, bans will be loaded from it.
+func NewBanList(opts BanListOpts) (*BanList, error) {
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = 5
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.BanTime <= 0 {
+		opts.BanTime = time.Minute * 10
+	}
+	if opts.MaxBanTime <= 0 {
+		opts.MaxBanTime = time.Hour * 24
+	}
+	b := &BanList{
+		opts:   opts,
+		logger: newConnLogger(opts.Logger, ""),
+		now:    time.Now,
+		peers:  make(map[string]*banEntry),
+	}
+
+	if len(opts.File) > 0 {
+		data, err := os.ReadFile(opts.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read ban file: %w", err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &b.peers); err != nil {
+				return nil, fmt.Errorf("invalid ban file: %w", err)
+			}
+		}
+	}
+	return b, nil
+}
+
+// Banned reports whether ip is banned.
+func (b *BanList) Banned(ip string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	e := b.peers[ip]
+	return e != nil && b.now().Before(e.Until)
+}
+
+// Fail records a failure of ip. reason is used for logging.
+func (b *BanList) Fail(ip string, reason string) {
+	now := b.now()
+	b.m.Lock()
+	b.sweepLocked(now)
+	e := b.peers[ip]
+	if e == nil {
+		e = new(banEntry)
+		b.peers[ip] = e
+	}
+	if now.Before(e.Until) { // already banned
+		b.m.Unlock()
+		return
+	}
+	if now.Sub(e.windowStart) > b.opts.Window {
+		e.windowStart = now
+		e.failures = 0
+	}
+	e.failures++
+	if e.failures < b.opts.MaxFailures {
+		b.m.Unlock()
+		return
+	}
+
+	// Reset the growth if ip behaved well for a long time.
+	if e.Bans > 0 && now.Sub(e.Until) > b.opts.MaxBanTime {
+		e.Bans = 0
+	}
+	d := b.opts.BanTime << e.Bans
+	if d > b.opts.MaxBanTime || d <= 0 {
+		d = b.opts.MaxBanTime
+	}
+	e.Bans++
+	e.Until = now.Add(d)
+	e.failures = 0
+	b.m.Unlock()
+
+	b.logger.l.Warn("ip banned", zap.String("ip", ip), zap.String("reason", reason), zap.Duration("ban_time", d))
+	if err := b.save(); err != nil {
+		b.logger.l.Error("failed to save ban list", zap.Error(err))
+	}
+}
+
+// fail is Fail with an addr.
+// Peers without an ip address, e.g. unix socket peers, are never banned.
+func (b *BanList) fail(addr net.Addr, reason string) {
+	if b == nil {
+		return
+	}
+	if ip, ok := peerIP(addr); ok {
+		b.Fail(ip, reason)
+	}
+}
+
+// handshakeFail reports a failed tls handshake with addr. Conns that were
+// closed before sending anything, e.g. L4 health checks of load balancers,
+// are not failures.
+func (b *BanList) handshakeFail(addr net.Addr, err error) {
+	if errors.Is(err, io.EOF) {
+		return
+	}
+	b.fail(addr, "tls handshake")
+}
+
+// sweepLocked removes expired entries at most once per Window.
+func (b *BanList) sweepLocked(now time.Time) {
+	if now.Sub(b.lastSweep) < b.opts.Window {
+		return
+	}
+	b.lastSweep = now
+	for ip, e := range b.peers {
+		banExpired := e.Bans == 0 || now.Sub(e.Until) > b.opts.MaxBanTime
+		if banExpired && now.Sub(e.windowStart) > b.opts.Window {
+			delete(b.peers, ip)
+		}
+	}
+}
+
+// save writes active bans to the file.
+func (b *BanList) save() error {
+	if len(b.opts.File) == 0 {
+		return nil
+	}
+	b.saveM.Lock()
+	defer b.saveM.Unlock()
+
+	b.m.Lock()
+	bans := make(map[string]*banEntry)
+	for ip, e := range b.peers {
+		if e.Bans > 0 {
+			bans[ip] = &banEntry{Until: e.Until, Bans: e.Bans}
+		}
+	}
+	b.m.Unlock()
+
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.opts.File), ".ban_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.opts.File)
+}
+
+// Listener returns a listener that closes the accepted conns from
+// banned IPs.
+func (b *BanList) Listener(l net.Listener) net.Listener {
+	if b == nil {
+		return l
+	}
+	return &banListener{Listener: l, b: b}
+}
+
+type banListener struct {
+	net.Listener
+	b *BanList
+}
+
+func (l *banListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := peerIP(c.RemoteAddr()); !ok || !l.b.Banned(ip) {
+			return c, nil
+		}
+		_ = c.Close()
+	}
+}
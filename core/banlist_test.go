@@ -0,0 +1,173 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for BanList that only moves by advance.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func Test_BanList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	opts := BanListOpts{MaxFailures: 3, Window: time.Minute, BanTime: time.Minute * 10, File: file}
+	b, err := NewBanList(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Now()}
+	b.now = clock.now
+
+	// Failures out of the window are not counted.
+	ip := "192.0.2.1"
+	for i := 0; i < 2; i++ {
+		b.Fail(ip, "test")
+	}
+	clock.advance(opts.Window + time.Second)
+	b.Fail(ip, "test")
+	if b.Banned(ip) {
+		t.Fatal("banned by failures out of the window")
+	}
+
+	b.Fail(ip, "test")
+	b.Fail(ip, "test")
+	if !b.Banned(ip) {
+		t.Fatal("ip should be banned")
+	}
+	clock.advance(opts.BanTime - time.Second)
+	if !b.Banned(ip) {
+		t.Fatal("the first ban expired too early")
+	}
+	clock.advance(time.Second)
+	if b.Banned(ip) {
+		t.Fatal("the first ban should be expired")
+	}
+
+	// The second ban doubles.
+	for i := 0; i < 3; i++ {
+		b.Fail(ip, "test")
+	}
+	clock.advance(opts.BanTime * 3 / 2)
+	if !b.Banned(ip) {
+		t.Fatal("the second ban should be longer than the first one")
+	}
+
+	// Bans are loaded from the file.
+	b2, err := NewBanList(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2.now = clock.now
+	if !b2.Banned(ip) || b2.Banned("192.0.2.2") {
+		t.Fatal("invalid bans from the file")
+	}
+
+	clock.advance(opts.BanTime / 2)
+	if b.Banned(ip) || b2.Banned(ip) {
+		t.Fatal("the second ban should be expired")
+	}
+}
+
+func Test_BanList_MaxBanTime(t *testing.T) {
+	opts := BanListOpts{MaxFailures: 1, BanTime: time.Minute * 10, MaxBanTime: time.Minute * 15}
+	b, err := NewBanList(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Now()}
+	b.now = clock.now
+
+	ip := "192.0.2.1"
+	b.Fail(ip, "test")
+	clock.advance(opts.BanTime)
+	b.Fail(ip, "test") // 20m, capped to 15m
+	clock.advance(opts.MaxBanTime - time.Second)
+	if !b.Banned(ip) {
+		t.Fatal("the second ban expired too early")
+	}
+	clock.advance(time.Second)
+	if b.Banned(ip) {
+		t.Fatal("ban time should be capped by MaxBanTime")
+	}
+}
+
+func Test_BanList_nonIP(t *testing.T) {
+	b, err := NewBanList(BanListOpts{MaxFailures: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unix socket peers have no ip, they must not share one ban entry.
+	b.fail(&net.UnixAddr{Name: "", Net: "unix"}, "test")
+	b.fail(&net.UnixAddr{Name: "@client", Net: "unix"}, "test")
+	b.m.Lock()
+	n := len(b.peers)
+	b.m.Unlock()
+	if n != 0 {
+		t.Fatalf("non-ip peers should not be recorded, got %d entries", n)
+	}
+}
+
+func Test_BanList_handshake(t *testing.T) {
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			bans, err := NewBanList(BanListOpts{MaxFailures: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     "127.0.0.1:0",
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				BanList:     bans,
+			})
+
+			dial := func(b []byte) {
+				c, err := net.Dial("tcp", serverAddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.Write(b)
+				c.(*net.TCPConn).CloseWrite()
+				c.SetReadDeadline(time.Now().Add(time.Second * 5))
+				c.Read(make([]byte, 1)) // wait for the server to close it.
+			}
+
+			// Connect-then-close, e.g. L4 health checks, are not failures.
+			dial(nil)
+			if bans.Banned("127.0.0.1") {
+				t.Fatal("banned by a conn that sent nothing")
+			}
+			dial([]byte("GET / HTTP/1.1\r\n\r\n"))
+			if !bans.Banned("127.0.0.1") {
+				t.Fatal("a non-tls conn should be banned")
+			}
+		})
+	}
+}
@@ -28,7 +28,6 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/simple-tls/core/ctunnel"
 	"github.com/IrineSistiana/simple-tls/core/grpc_lb"
-	"github.com/IrineSistiana/simple-tls/core/mlog"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
@@ -37,78 +36,270 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Client struct {
-	BindAddr        string
+	// BindAddr is the listen address. It can also be a unix socket,
+	// "unix:/path" or "unix:@name" (abstract, linux only).
+	BindAddr string
+	// DstAddr is the server address. It can also be a server list for
+	// failover, see ParseUpstreams. Other server options of the Client
+	// are the defaults of the servers in the list.
 	DstAddr         string
 	GRPC            bool
 	GRPCServiceName string
 
+	// Upstreams, if not empty, overrides DstAddr and the server options.
+	// Servers are tried in order. If a server fails, it will be marked
+	// as unhealthy with a backoff, and the next one will be used.
+	Upstreams []Upstream
+	// ProbeInterval, if > 0, enables the latency based server selection.
+	// Servers are probed every ProbeInterval by the tls handshake RTT (or
+	// a grpc health check RTT in grpc mode). New tunnels are sent to the
+	// server with the lowest smoothed latency and loss first. See Status.
+	ProbeInterval time.Duration
+
 	ServerName         string
 	CA                 string
 	CertHash           string
 	InsecureSkipVerify bool
 
+	// Proxy is the upstream proxy to connect to the servers,
+	// "http://[user:pass@]host:port" or "socks5://[user:pass@]host:port".
+	// The tls handshake is still end-to-end.
+	Proxy string
+
 	IdleTimeout time.Duration
+	// SocketOpts is applied to the sockets to the servers and the
+	// listener, see TcpConfig.
 	SocketOpts  *TcpConfig
 	OutboundBuf int
 	InboundBuf  int
 
-	testListener net.Listener
+	// IPFilter, if not nil, closes connections from denied source IPs
+	// right after they were accepted.
+	IPFilter *IPFilter
+	// UnixSocket is used if BindAddr is a unix socket.
+	UnixSocket UnixSocketOpts
+	// Listeners is the number of listeners that ActiveAndServe opens on
+	// BindAddr with SO_REUSEPORT, each has its own accept loop. Default
+	// is 1. Linux only.
+	Listeners int
+	// ActivatedListeners, if not empty, are served by ActiveAndServe
+	// instead of listening on BindAddr, e.g. the listeners from systemd
+	// socket activation. Only UnixSocket.AllowUIDs is applied to them,
+	// Listeners and the other UnixSocket opts are not used.
+	ActivatedListeners []net.Listener
+
+	// Logger is the logger of the client. If nil, the global logger from
+	// package mlog will be used.
+	Logger *zap.Logger
+	// Name is the name of the client. If not empty, it will be used to
+	// name the Logger. So logs from different instances can be told apart.
+	Name string
+
+	initOnce   sync.Once
+	initErr    error
+	dialRemote func(ctx context.Context) (net.Conn, error)
+	upstreams  []*upstream
+	logger     connLogger
+
+	selectM   sync.Mutex
+	selected  *upstream     // the best server by probes, can be nil.
+	probeStop chan struct{} // nil if probe is disabled.
+	stopOnce  sync.Once
+
+	fastOpenConns uint64 // atomic
+
+	lc lifecycle
 }
 
 var errEmptyCAFile = errors.New("no valid certificate was found in the ca file")
 
+// ErrClientClosed is returned by Client.Serve after a call to
+// Client.Shutdown or Client.Close.
+var ErrClientClosed = errors.New("client closed")
+
+// ActiveAndServe listens on c.BindAddr and serves it, see Listeners.
 func (c *Client) ActiveAndServe() error {
-	var l net.Listener
-	if c.testListener != nil {
-		l = c.testListener
+	c.initOnce.Do(func() {
+		c.initErr = c.init()
+	})
+	if c.initErr != nil {
+		return c.initErr
+	}
+	var ls []net.Listener
+	var err error
+	if len(c.ActivatedListeners) > 0 {
+		ls, err = activatedListeners(c.ActivatedListeners, c.UnixSocket, c.logger)
 	} else {
+		ls, err = listenN(c.BindAddr, c.Listeners, c.UnixSocket, c.SocketOpts, c.logger)
+	}
+	if err != nil {
+		return err
+	}
+	return serveListeners(ls, func(l net.Listener) error {
+		return c.Serve(context.Background(), l)
+	})
+}
+
+// Serve accepts connections on l and forwards them to the server until
+// ctx is done or the client is closed. If ctx is done, the client will
+// be closed. Serve can be called multiple times with different listeners.
+// l will be closed when Serve returns.
+func (c *Client) Serve(ctx context.Context, l net.Listener) error {
+	defer l.Close()
+
+	c.initOnce.Do(func() {
+		c.initErr = c.init()
+	})
+	if c.initErr != nil {
+		return c.initErr
+	}
+
+	if !c.lc.addListener(l) {
+		return ErrClientClosed
+	}
+	defer c.lc.removeListener(l)
+
+	serveDone := make(chan struct{})
+	defer close(serveDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+		case <-serveDone:
+		}
+	}()
+
+	err := c.serve(wrapListener(c.IPFilter.listener(l, c.logger), c.InboundBuf))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if c.lc.isClosed() {
+		return ErrClientClosed
+	}
+	return err
+}
+
+// Ready returns a channel that is closed when the client starts
+// serving its first listener.
+func (c *Client) Ready() <-chan struct{} {
+	return c.lc.readyChan()
+}
+
+// FastOpenConns returns the number of conns to the servers that used
+// tcp fast open, see TcpConfig.FastOpen.
+func (c *Client) FastOpenConns() uint64 {
+	return atomic.LoadUint64(&c.fastOpenConns)
+}
+
+// Addr returns the address of the first listener that the client serves.
+// It returns nil if the client is not ready.
+func (c *Client) Addr() net.Addr {
+	return c.lc.listenAddr()
+}
+
+// Dial opens a new tunnel to the server. The returned conn is connected
+// to the server's destination. Dial does not need a listener, Serve
+// is not required to be called.
+// Conns returned by Dial are owned by the caller, they won't be drained
+// by Shutdown. But in grpc mode, they will be closed after Shutdown.
+func (c *Client) Dial(ctx context.Context) (net.Conn, error) {
+	c.initOnce.Do(func() {
+		c.initErr = c.init()
+	})
+	if c.initErr != nil {
+		return nil, c.initErr
+	}
+	if c.lc.isClosed() {
+		return nil, ErrClientClosed
+	}
+	return c.dialRemote(ctx)
+}
+
+var _ Transport = (*Client)(nil)
+
+func (c *Client) init() error {
+	c.logger = newConnLogger(c.Logger, c.Name)
+	if err := c.SocketOpts.validate(); err != nil {
+		return err
+	}
+
+	ups := c.Upstreams
+	if len(ups) == 0 {
 		var err error
-		lc := net.ListenConfig{}
-		l, err = lc.Listen(context.Background(), "tcp", c.BindAddr)
+		ups, err = ParseUpstreams(c.DstAddr, Upstream{
+			ServerName:         c.ServerName,
+			CA:                 c.CA,
+			CertHash:           c.CertHash,
+			InsecureSkipVerify: c.InsecureSkipVerify,
+			GRPC:               c.GRPC,
+			GRPCServiceName:    c.GRPCServiceName,
+		})
 		if err != nil {
 			return err
 		}
 	}
-	l = wrapListener(l, c.InboundBuf)
+	for _, u := range ups {
+		up, err := c.newUpstream(u)
+		if err != nil {
+			return fmt.Errorf("invalid server %s: %w", u.Addr, err)
+		}
+		c.upstreams = append(c.upstreams, up)
+	}
+	c.dialRemote = c.dialUpstreams
+	if c.ProbeInterval > 0 {
+		c.probeStop = make(chan struct{})
+		go c.probeLoop(c.probeStop)
+	}
+	return nil
+}
 
-	if len(c.ServerName) == 0 {
-		c.ServerName = strings.SplitN(c.DstAddr, ":", 2)[0]
+// newUpstream builds the dialer of u.
+func (c *Client) newUpstream(u Upstream) (*upstream, error) {
+	if len(u.ServerName) == 0 {
+		u.ServerName = strings.SplitN(u.Addr, ":", 2)[0]
 	}
 
 	var rootCAs *x509.CertPool
-	if len(c.CA) != 0 {
+	if len(u.CA) != 0 {
 		rootCAs = x509.NewCertPool()
-		certPEMBlock, err := os.ReadFile(c.CA)
+		certPEMBlock, err := os.ReadFile(u.CA)
 		if err != nil {
-			return fmt.Errorf("cannot read ca file: %w", err)
+			return nil, fmt.Errorf("cannot read ca file: %w", err)
 		}
 		if ok := rootCAs.AppendCertsFromPEM(certPEMBlock); !ok {
-			return errEmptyCAFile
+			return nil, errEmptyCAFile
 		}
 	}
 
-	dialer := &net.Dialer{
-		Timeout: time.Second * 5,
-		Control: GetControlFunc(c.SocketOpts),
+	dialer := c.SocketOpts.newDialer(time.Second * 5)
+	dialContext := dialer.DialContext
+	if len(c.Proxy) > 0 {
+		d, err := newProxyDialer(c.Proxy, dialer)
+		if err != nil {
+			return nil, err
+		}
+		dialContext = d
 	}
 
 	var chb []byte
-	if len(c.CertHash) != 0 {
-		b, err := hex.DecodeString(c.CertHash)
+	if len(u.CertHash) != 0 {
+		b, err := hex.DecodeString(u.CertHash)
 		if err != nil {
-			return fmt.Errorf("invalid cert hash: %w", err)
+			return nil, fmt.Errorf("invalid cert hash: %w", err)
 		}
 		chb = b
 	}
 
 	tlsConfig := &tls.Config{
-		ServerName:         c.ServerName,
+		ServerName:         u.ServerName,
 		RootCAs:            rootCAs,
-		InsecureSkipVerify: len(chb) > 0 || c.InsecureSkipVerify,
+		InsecureSkipVerify: len(chb) > 0 || u.InsecureSkipVerify,
 		VerifyConnection: func(state tls.ConnectionState) error {
 			if len(chb) > 0 {
 				cert := state.PeerCertificates[0]
@@ -126,8 +317,8 @@ func (c *Client) ActiveAndServe() error {
 		},
 	}
 
-	var dialRemote func(ctx context.Context) (net.Conn, error)
-	if c.GRPC {
+	up := &upstream{Upstream: u}
+	if u.GRPC {
 		grpcDialOpts := []grpc.DialOption{
 			grpc.WithKeepaliveParams(keepalive.ClientParameters{
 				Time:                time.Second * 90,
@@ -146,34 +337,64 @@ func (c *Client) ActiveAndServe() error {
 			grpc.WithInitialConnWindowSize(1024 * 1024),
 			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
 			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
-				remoteConn, err := dialer.DialContext(ctx, "tcp", s)
-				if remoteConn != nil {
-					applyTCPSocketBuf(remoteConn, c.OutboundBuf)
+				remoteConn, err := dialContext(ctx, "tcp", s)
+				if err != nil {
+					return nil, err
 				}
-				return remoteConn, err
+				applyTCPSocketBuf(remoteConn, c.OutboundBuf)
+				return wrapFastOpenConn(remoteConn, c.SocketOpts, &c.fastOpenConns), nil
 			}),
 		}
 		grpcConnPool := grpc_lb.NewConnPool(grpc_lb.ConnPoolOpts{
-			Target:      c.DstAddr,
-			ServiceName: c.GRPCServiceName,
+			Target:      u.Addr,
+			ServiceName: u.GRPCServiceName,
 			DialOpts:    grpcDialOpts,
-			Logger:      logger.Named("grpc_cc_pool"),
+			Logger:      c.logger.l.Named("grpc_cc_pool").With(zap.String("server", u.Addr)),
 		})
-
-		dialRemote = func(ctx context.Context) (net.Conn, error) {
+		up.connPool = grpcConnPool
+		up.dial = func(ctx context.Context) (net.Conn, error) {
 			return grpcConnPool.GetConn(ctx)
 		}
+		up.probe = grpcHealthProbe(up, grpcDialOpts)
 	} else {
-		dialRemote = func(ctx context.Context) (net.Conn, error) {
-			tlsDialer := tls.Dialer{NetDialer: dialer, Config: tlsConfig}
-			remoteConn, err := tlsDialer.DialContext(ctx, "tcp", c.DstAddr)
-			if remoteConn != nil {
-				applyTCPSocketBuf(remoteConn, c.OutboundBuf)
+		handshake := func(ctx context.Context, tlsConfig *tls.Config) (*tls.Conn, error) {
+			if _, ok := ctx.Deadline(); !ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+				defer cancel()
+			}
+			remoteConn, err := dialContext(ctx, "tcp", u.Addr)
+			if err != nil {
+				return nil, err
+			}
+			applyTCPSocketBuf(remoteConn, c.OutboundBuf)
+			tlsConn := tls.Client(wrapFastOpenConn(remoteConn, c.SocketOpts, &c.fastOpenConns), tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				remoteConn.Close()
+				return nil, err
 			}
-			return remoteConn, err
+			return tlsConn, nil
+		}
+		up.dial = func(ctx context.Context) (net.Conn, error) {
+			return handshake(ctx, tlsConfig)
+		}
+
+		// Probes offer probeALPN, so the server closes them right after
+		// the handshake instead of opening a tunnel to its dst.
+		probeTLSConfig := tlsConfig.Clone()
+		probeTLSConfig.NextProtos = []string{probeALPN}
+		up.probe = func(ctx context.Context) error {
+			conn, err := handshake(ctx, probeTLSConfig)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
 		}
 	}
+	return up, nil
+}
 
+func (c *Client) serve(l net.Listener) error {
 	for {
 		clientConn, err := l.Accept()
 		if err != nil {
@@ -182,24 +403,65 @@ func (c *Client) ActiveAndServe() error {
 
 		go func() {
 			defer clientConn.Close()
+			if !c.lc.tunnels.add(clientConn, nil) {
+				return
+			}
+			defer c.lc.tunnels.remove(clientConn)
 
+			cl := c.logger.forConn(clientConn)
+			cl.l.Debug("new conn")
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 			defer cancel()
-			serverConn, err := dialRemote(ctx)
+			serverConn, err := c.Dial(ctx)
 			if err != nil {
-				logger.Error("failed to dial server connection", zap.Error(err))
+				cl.l.Error("failed to dial server connection", zap.Error(err))
 				return
 			}
 			defer serverConn.Close()
+			cl.l.Debug("server connected")
 
-			err = ctunnel.OpenTunnel(clientConn, serverConn, ctunnel.TunnelOpts{IdleTimout: c.IdleTimeout})
+			_, err = ctunnel.OpenTunnel(clientConn, serverConn, ctunnel.TunnelOpts{IdleTimout: c.IdleTimeout, Logger: cl.l})
 			if err != nil {
-				mlog.LogConnErr("tunnel closed with err", clientConn, err)
+				cl.logConnErr("tunnel closed with err", err)
 			}
 		}()
 	}
 }
 
+// Shutdown gracefully shuts down the client. It stops accepting new
+// connections and waits for active tunnels to finish. If ctx is done
+// before that, remaining tunnels are force-closed and ctx.Err() is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.lc.close()
+	err := c.lc.tunnels.wait(ctx)
+	c.lc.tunnels.closeAll()
+
+	// Make sure that init won't run after Shutdown, so we can safely
+	// access upstreams.
+	c.initOnce.Do(func() {
+		c.initErr = ErrClientClosed
+	})
+	c.stopOnce.Do(func() {
+		if c.probeStop != nil {
+			close(c.probeStop)
+		}
+		for _, u := range c.upstreams {
+			u.close()
+		}
+	})
+	return err
+}
+
+// Close immediately closes the client and all its active tunnels.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Shutdown(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
 // listenerWrapper automatically set tcp socket buf when new conn is accepted.
 type listenerWrapper struct {
 	buf    int
@@ -0,0 +1,91 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// connGroup tracks active tunnels, so they can be drained or
+// force-closed on shutdown.
+type connGroup struct {
+	m      sync.Mutex
+	closed bool
+	conns  map[io.Closer]context.CancelFunc
+}
+
+// add adds c to the group. cancel, if not nil, is called together with
+// c.Close by closeAll. If the group was closed, add returns false
+// and c should be closed by the caller.
+func (g *connGroup) add(c io.Closer, cancel context.CancelFunc) bool {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.closed {
+		return false
+	}
+	if g.conns == nil {
+		g.conns = make(map[io.Closer]context.CancelFunc)
+	}
+	g.conns[c] = cancel
+	return true
+}
+
+func (g *connGroup) remove(c io.Closer) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	delete(g.conns, c)
+}
+
+func (g *connGroup) len() int {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return len(g.conns)
+}
+
+// closeAll closes all conns in the group and cancels their contexts.
+// Conns that are added after closeAll will be rejected.
+func (g *connGroup) closeAll() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.closed = true
+	for c, cancel := range g.conns {
+		if cancel != nil {
+			cancel()
+		}
+		_ = c.Close()
+	}
+}
+
+// wait waits until the group is empty or ctx is done.
+func (g *connGroup) wait(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for {
+		if g.len() == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,161 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/IrineSistiana/simple-tls/core/ratelimit"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+)
+
+// ConnLimits limits the connections of a Server. Zero values mean unlimited.
+// Connections that exceed the limits are closed right after they were
+// accepted, before the tls handshake.
+// In grpc mode, MaxConns and MaxConnsPerIP limit both the connections and
+// the tunnels (streams), and MaxConnsPerRoute limits the tunnels.
+type ConnLimits struct {
+	// MaxConns is the maximum number of concurrent tunnels in total.
+	MaxConns int
+	// MaxConnsPerIP is the maximum number of concurrent tunnels from
+	// the same source IP.
+	MaxConnsPerIP int
+	// MaxConnsPerRoute is the maximum number of concurrent tunnels of
+	// each route.
+	MaxConnsPerRoute int
+	// AcceptRate is the maximum number of new connections per second,
+	// with burst AcceptBurst.
+	AcceptRate  float64
+	AcceptBurst int
+}
+
+// connLimiter counts active conns and checks them against limits.
+type connLimiter struct {
+	limits ConnLimits
+	accept *ratelimit.Bucket // nil if AcceptRate is unlimited.
+
+	m        sync.Mutex
+	total    int
+	perIP    map[string]int
+	perRoute map[string]int
+}
+
+// newConnLimiter returns nil if limits has no limit.
+func newConnLimiter(limits ConnLimits) *connLimiter {
+	if limits == (ConnLimits{}) {
+		return nil
+	}
+	cl := &connLimiter{
+		limits:   limits,
+		perIP:    make(map[string]int),
+		perRoute: make(map[string]int),
+	}
+	if limits.AcceptRate > 0 {
+		cl.accept = ratelimit.NewBucket(limits.AcceptRate, limits.AcceptBurst)
+	}
+	return cl
+}
+
+// acquire takes a slot for a new conn. It returns ErrRateLimited or
+// ErrTooManyConns if the conn exceeds the limits. Otherwise, release must
+// be called when the conn is closed. An empty ip, e.g. of a unix socket
+// peer, is exempt from MaxConnsPerIP.
+func (cl *connLimiter) acquire(ip, route string) error {
+	if cl.accept != nil && !cl.accept.Allow() {
+		return ErrRateLimited
+	}
+
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	if exceeds(cl.total, cl.limits.MaxConns) ||
+		(len(ip) > 0 && exceeds(cl.perIP[ip], cl.limits.MaxConnsPerIP)) ||
+		exceeds(cl.perRoute[route], cl.limits.MaxConnsPerRoute) {
+		return ErrTooManyConns
+	}
+	cl.total++
+	if len(ip) > 0 {
+		cl.perIP[ip]++
+	}
+	cl.perRoute[route]++
+	return nil
+}
+
+func exceeds(n, limit int) bool {
+	return limit > 0 && n >= limit
+}
+
+func (cl *connLimiter) release(ip, route string) {
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	cl.total--
+	if len(ip) > 0 {
+		if cl.perIP[ip]--; cl.perIP[ip] <= 0 {
+			delete(cl.perIP, ip)
+		}
+	}
+	if cl.perRoute[route]--; cl.perRoute[route] <= 0 {
+		delete(cl.perRoute, route)
+	}
+}
+
+// limitListener closes accepted conns that exceed the limits of limiter.
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	route   string
+	logger  connLogger
+}
+
+func newLimitListener(l net.Listener, limiter *connLimiter, route string, logger connLogger) net.Listener {
+	if limiter == nil {
+		return l
+	}
+	return &limitListener{Listener: l, limiter: limiter, route: route, logger: logger}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _ := peerIP(c.RemoteAddr())
+		if err := l.limiter.acquire(ip, l.route); err != nil {
+			l.logger.errLog.Warn("conn rejected", zap.Stringer("remote", c.RemoteAddr()), zap.Error(err))
+			_ = c.Close()
+			continue
+		}
+		return &limitConn{Conn: c, release: func() { l.limiter.release(ip, l.route) }}, nil
+	}
+}
+
+// limitConn calls release once when it is closed.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	c.releaseOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *limitConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -18,14 +18,23 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/IrineSistiana/simple-tls/core/proxyproto"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -98,14 +107,13 @@ func Test_main(t *testing.T) {
 			GRPC:            grpc,
 			GRPCServiceName: auth,
 			IdleTimeout:     timeout,
-			testListener:    serverListener,
 			testCert:        &cert,
 		}
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := server.ActiveAndServe()
+			err := server.Serve(context.Background(), serverListener)
 			if err != nil && atomic.LoadUint32(&testFinished) == 0 {
 				t.Errorf("server exited too early: %v", err)
 			}
@@ -125,13 +133,12 @@ func Test_main(t *testing.T) {
 			CertHash:           certHash,
 			InsecureSkipVerify: true,
 			IdleTimeout:        timeout,
-			testListener:       clientListener,
 		}
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := client.ActiveAndServe()
+			err := client.Serve(context.Background(), clientListener)
 			if err != nil && atomic.LoadUint32(&testFinished) == 0 {
 				t.Errorf("client exited too early: %v", err)
 			}
@@ -195,3 +202,738 @@ func Test_main(t *testing.T) {
 		}
 	}
 }
+
+func Test_Shutdown(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	test := func(t *testing.T, grpc, force bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		server := &Server{
+			DstAddr:     echoListener.Addr().String(),
+			GRPC:        grpc,
+			IdleTimeout: time.Minute,
+		}
+		serverAddr, serverErr := startTestServer(t, server)
+		client := &Client{
+			DstAddr:            serverAddr,
+			GRPC:               grpc,
+			InsecureSkipVerify: true,
+			IdleTimeout:        time.Minute,
+			ProbeInterval:      time.Minute,
+		}
+		clientAddr := startTestClient(t, ctx, client)
+
+		conn, err := net.Dial("tcp", clientAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		if err := checkEcho(conn); err != nil {
+			t.Fatal(err)
+		}
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+		defer shutdownCancel()
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- server.Shutdown(shutdownCtx)
+		}()
+
+		// Wait until the server stops accepting. New connections should be
+		// refused while the active tunnel still works.
+		time.Sleep(time.Millisecond * 100)
+		if c, err := net.Dial("tcp", serverAddr); err == nil {
+			c.Close()
+			t.Fatal("server should refuse new connections")
+		}
+		if err := checkEcho(conn); err != nil {
+			t.Fatalf("tunnel broken while draining: %v", err)
+		}
+
+		if force {
+			if err := <-shutdownErr; err != context.DeadlineExceeded {
+				t.Fatalf("want a deadline err, got %v", err)
+			}
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("tunnel should be closed")
+			}
+		} else {
+			conn.Close()
+			if err := <-shutdownErr; err != nil {
+				t.Fatalf("shutdown err: %v", err)
+			}
+		}
+		if err := <-serverErr; err != ErrServerClosed {
+			t.Fatalf("want ErrServerClosed, got %v", err)
+		}
+
+		// Shutdown and Close can be called more than once, also while
+		// Serve is closing the client because its ctx is done.
+		cancel()
+		clientShutdownCtx, clientShutdownCancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer clientShutdownCancel()
+		if err := client.Shutdown(clientShutdownCtx); err != nil {
+			t.Fatalf("client shutdown err: %v", err)
+		}
+		if err := client.Shutdown(clientShutdownCtx); err != nil {
+			t.Fatalf("second client shutdown err: %v", err)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatalf("client close err: %v", err)
+		}
+		if err := server.Close(); err != nil {
+			t.Fatalf("server close err: %v", err)
+		}
+	}
+
+	for _, grpc := range [...]bool{false, true} {
+		for _, force := range [...]bool{false, true} {
+			t.Run(fmt.Sprintf("grpc_%v_force_%v", grpc, force), func(t *testing.T) {
+				test(t, grpc, force)
+			})
+		}
+	}
+}
+
+func Test_Server_Close_cancelsCtx(t *testing.T) {
+	handlerStarted := make(chan struct{})
+	handlerDone := make(chan error, 1)
+	server := &Server{
+		Handler: TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			close(handlerStarted)
+			<-ctx.Done()
+			handlerDone <- ctx.Err()
+			return nil
+		}),
+	}
+	serverAddr, _ := startTestServer(t, server)
+
+	conn, err := tls.Dial("tcp", serverAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Finish the server side handshake.
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	<-handlerStarted
+
+	server.Close()
+	select {
+	case err := <-handlerDone:
+		if err != context.Canceled {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("handler ctx was not canceled by Close")
+	}
+}
+
+func Test_ClientDial(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			logCore, logs := observer.New(zapcore.DebugLevel)
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     echoListener.Addr().String(),
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				Logger:      zap.New(logCore),
+				Name:        "test_server",
+			})
+			var transport Transport = &Client{
+				DstAddr:            serverAddr,
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+			}
+			defer transport.(*Client).Close()
+			dialEcho(t, transport)
+
+			dstLogs := logs.FilterMessage("dst connected").All()
+			if len(dstLogs) != 1 {
+				t.Fatalf("want 1 dst log, got %d", len(dstLogs))
+			}
+			fields := dstLogs[0].ContextMap()
+			if dstLogs[0].LoggerName != "test_server" || fields["conn_id"] == nil || fields["route"] == nil {
+				t.Fatalf("invalid log entry %v %v", dstLogs[0].LoggerName, fields)
+			}
+		})
+	}
+}
+
+func Test_TransportListener(t *testing.T) {
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			tl := NewTransportListener()
+			defer tl.Close()
+			go serveEcho(tl)
+
+			serverAddr, _ := startTestServer(t, &Server{
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				Handler:     tl,
+			})
+			client := &Client{
+				DstAddr:            serverAddr,
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+			}
+			defer client.Close()
+			dialEcho(t, client)
+		})
+	}
+}
+
+func Test_HalfClose(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     echoListener.Addr().String(),
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+			})
+			client := &Client{
+				DstAddr:            serverAddr,
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+			}
+			defer client.Close()
+			conn := dialEcho(t, client)
+
+			b := []byte("hello")
+			if _, err := conn.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The echo server closes the conn after it read EOF. Data
+			// written before CloseWrite should be echoed back.
+			buf, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, buf) {
+				t.Fatal("corrupted data")
+			}
+		})
+	}
+}
+
+func Test_ConnLimits(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     echoListener.Addr().String(),
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				Limits:      ConnLimits{MaxConnsPerIP: 1},
+			})
+			client := &Client{
+				DstAddr:            serverAddr,
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+			}
+			defer client.Close()
+			dialEcho(t, client)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			conn, err := client.Dial(ctx)
+			if err == nil {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(time.Second * 5))
+				err = checkEcho(conn)
+			}
+			if err == nil {
+				t.Fatal("the second tunnel should be rejected")
+			}
+		})
+	}
+}
+
+func Test_connLimiter_nonIP(t *testing.T) {
+	cl := newConnLimiter(ConnLimits{MaxConnsPerIP: 1})
+	// Peers without an ip, e.g. unix socket peers, are exempt from
+	// MaxConnsPerIP.
+	for i := 0; i < 2; i++ {
+		if err := cl.acquire("", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cl.acquire("192.0.2.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.acquire("192.0.2.1", ""); err != ErrTooManyConns {
+		t.Fatalf("want ErrTooManyConns, got %v", err)
+	}
+	cl.release("", "")
+	cl.release("", "")
+	if len(cl.perIP) != 1 {
+		t.Fatalf("unexpected per ip counters %v", cl.perIP)
+	}
+}
+
+func Test_ClientFailover(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	// countTunnels returns a Server that counts its tunnels in n.
+	countTunnels := func(n *int32) *Server {
+		return &Server{
+			DstAddr:     echoListener.Addr().String(),
+			IdleTimeout: time.Minute,
+			Middlewares: []Middleware{func(next TransportHandler) TransportHandler {
+				return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+					atomic.AddInt32(n, 1)
+					return next.Handle(ctx, conn)
+				})
+			}},
+		}
+	}
+	var primaryTunnels, backupTunnels int32
+	backupAddr, _ := startTestServer(t, countTunnels(&backupTunnels))
+
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primaryAddr := deadListener.Addr().String()
+	deadListener.Close()
+
+	ups, err := ParseUpstreams(primaryAddr+","+backupAddr+"?n=test.server", Upstream{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ups[1].ServerName != "test.server" {
+		t.Fatal("server options were not parsed")
+	}
+	client := &Client{Upstreams: ups}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		dialEcho(t, client)
+	}
+	if n := atomic.LoadInt32(&backupTunnels); n != 2 {
+		t.Fatalf("want 2 tunnels on the backup server, got %d", n)
+	}
+	if client.Status()[0].Healthy {
+		t.Fatal("the dead server should be unhealthy")
+	}
+
+	// The primary server recovers. It is used again after its backoff.
+	primaryListener, err := net.Listen("tcp", primaryAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := countTunnels(&primaryTunnels)
+	cert := newTestCert(t)
+	primary.testCert = &cert
+	go primary.Serve(context.Background(), primaryListener)
+	defer primary.Close()
+	for !client.Status()[0].Healthy {
+		time.Sleep(time.Millisecond * 50)
+	}
+	dialEcho(t, client)
+	if n := atomic.LoadInt32(&primaryTunnels); n != 1 {
+		t.Fatalf("the primary server should be used again, got %d tunnels", n)
+	}
+}
+
+func Test_ClientProbe(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			bans, err := NewBanList(BanListOpts{MaxFailures: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tunnels int32
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     echoListener.Addr().String(),
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				BanList:     bans,
+				Middlewares: []Middleware{func(next TransportHandler) TransportHandler {
+					return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+						atomic.AddInt32(&tunnels, 1)
+						return next.Handle(ctx, conn)
+					})
+				}},
+			})
+
+			deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			deadListener.Close()
+
+			client := &Client{
+				DstAddr:            deadListener.Addr().String() + "," + serverAddr,
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+				ProbeInterval:      time.Millisecond * 50,
+			}
+			defer client.Close()
+			// The echo makes sure that the tunnel has reached the handler.
+			dialEcho(t, client).Close()
+
+			// The alive server should be selected.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			for {
+				s := client.Status()
+				if s[1].Selected {
+					if s[0].Loss == 0 || s[1].RTT == 0 {
+						t.Fatalf("invalid status %+v", s)
+					}
+					break
+				}
+				select {
+				case <-ctx.Done():
+					t.Fatalf("server was not selected, status %+v", s)
+				case <-time.After(time.Millisecond * 50):
+				}
+			}
+
+			// Probes should neither open tunnels nor be counted as failures.
+			if n := atomic.LoadInt32(&tunnels); n != 1 {
+				t.Fatalf("want 1 tunnel, got %d", n)
+			}
+			if bans.Banned("127.0.0.1") {
+				t.Fatal("the client should not be banned by probes")
+			}
+		})
+	}
+}
+
+func Test_SendProxy(t *testing.T) {
+	for _, grpc := range [...]bool{false, true} {
+		for _, version := range [...]int{1, 2} {
+			t.Run(fmt.Sprintf("grpc_%v_v%d", grpc, version), func(t *testing.T) {
+				dstListener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer dstListener.Close()
+				received := make(chan []byte, 1)
+				go func() {
+					c, err := dstListener.Accept()
+					if err != nil {
+						return
+					}
+					defer c.Close()
+					c.SetDeadline(time.Now().Add(time.Second * 5))
+					var b []byte
+					buf := make([]byte, 512)
+					for !bytes.HasSuffix(b, []byte("hello")) {
+						n, err := c.Read(buf)
+						b = append(b, buf[:n]...)
+						if err != nil {
+							break
+						}
+					}
+					received <- b
+				}()
+
+				serverAddr, _ := startTestServer(t, &Server{
+					DstAddr:     dstListener.Addr().String(),
+					GRPC:        grpc,
+					IdleTimeout: time.Minute,
+					SendProxy:   version,
+				})
+				client := &Client{
+					DstAddr:            serverAddr,
+					GRPC:               grpc,
+					ServerName:         "example.com",
+					InsecureSkipVerify: true,
+				}
+				defer client.Close()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				defer cancel()
+				conn, err := client.Dial(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte("hello")); err != nil {
+					t.Fatal(err)
+				}
+
+				b := <-received
+				if !bytes.HasSuffix(b, []byte("hello")) {
+					t.Fatalf("data is not received, got %q", b)
+				}
+				// The dst address of the header is the server's listen address.
+				_, port, _ := net.SplitHostPort(serverAddr)
+				serverPort, _ := strconv.Atoi(port)
+				switch version {
+				case 1:
+					if !bytes.HasPrefix(b, []byte("PROXY TCP4 127.0.0.1 127.0.0.1 ")) ||
+						!bytes.Contains(b, []byte(fmt.Sprintf(" %d\r\n", serverPort))) {
+						t.Fatalf("invalid v1 header %q", b)
+					}
+				case 2:
+					if !bytes.HasPrefix(b, []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11")) ||
+						!bytes.Equal(b[16:24], []byte{127, 0, 0, 1, 127, 0, 0, 1}) ||
+						int(binary.BigEndian.Uint16(b[26:28])) != serverPort {
+						t.Fatalf("invalid v2 header %x", b)
+					}
+					sni := append([]byte{0x02, 0, 11}, "example.com"...)
+					if !bytes.Contains(b, sni) {
+						t.Fatalf("sni tlv is missing %x", b)
+					}
+				}
+			})
+		}
+	}
+}
+
+func Test_AcceptProxy(t *testing.T) {
+	for _, grpc := range [...]bool{false, true} {
+		t.Run(fmt.Sprintf("grpc_%v", grpc), func(t *testing.T) {
+			dstListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dstListener.Close()
+			received := make(chan string, 1)
+			go func() {
+				c, err := dstListener.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(time.Second * 5))
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				received <- line
+			}()
+
+			serverAddr, _ := startTestServer(t, &Server{
+				DstAddr:     dstListener.Addr().String(),
+				GRPC:        grpc,
+				IdleTimeout: time.Minute,
+				SendProxy:   1,
+				AcceptProxy: []string{"127.0.0.0/8"},
+			})
+
+			// A load balancer that sends v2 headers.
+			lbListener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lbListener.Close()
+			go func() {
+				for {
+					c, err := lbListener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer c.Close()
+						s, err := net.Dial("tcp", serverAddr)
+						if err != nil {
+							return
+						}
+						defer s.Close()
+						h := proxyproto.Header{
+							Version: 2,
+							Src:     &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 1234},
+							Dst:     &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+						}
+						if _, err := h.WriteTo(s); err != nil {
+							return
+						}
+						go io.Copy(s, c)
+						io.Copy(c, s)
+					}()
+				}
+			}()
+
+			client := &Client{
+				DstAddr:            lbListener.Addr().String(),
+				GRPC:               grpc,
+				InsecureSkipVerify: true,
+			}
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			conn, err := client.Dial(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+
+			want := "PROXY TCP4 203.0.113.7 198.51.100.1 1234 443\r\n"
+			if line := <-received; line != want {
+				t.Fatalf("want header %q, got %q", want, line)
+			}
+		})
+	}
+}
+
+// tempErrListener returns n temporary errors before accepting conns.
+type tempErrListener struct {
+	net.Listener
+	n int32
+}
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary error" }
+func (tempErr) Timeout() bool   { return false }
+func (tempErr) Temporary() bool { return true }
+
+func (l *tempErrListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.n, -1) >= 0 {
+		return nil, tempErr{}
+	}
+	return l.Listener.Accept()
+}
+
+func Test_proxyProtoListener_tempErr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	pl := newProxyProtoListener(&tempErrListener{Listener: l, n: 3}, []*net.IPNet{trusted}, 0, newConnLogger(nil, ""))
+	defer pl.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("temporary errors should be retried, got %v", err)
+	}
+	ac.Close()
+
+	pl.Close()
+	if _, err := pl.Accept(); err == nil {
+		t.Fatal("accept should fail after close")
+	}
+}
+
+// startTestServer serves s on a local tcp port, with a test certificate
+// if s has none. s is closed when the test finishes. serveErr receives
+// the result of s.Serve.
+func startTestServer(t *testing.T, s *Server) (addr string, serveErr <-chan error) {
+	t.Helper()
+	if s.testCert == nil {
+		cert := newTestCert(t)
+		s.testCert = &cert
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Serve(context.Background(), l)
+	}()
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String(), errC
+}
+
+// startTestClient serves c on a local tcp port until ctx is done.
+// c is closed when the test finishes.
+func startTestClient(t *testing.T, ctx context.Context, c *Client) (addr string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(ctx, l)
+	t.Cleanup(func() { c.Close() })
+	return l.Addr().String()
+}
+
+// dialEcho dials a tunnel to an echo server with d and checks that
+// data is echoed back. The tunnel is closed when the test finishes.
+func dialEcho(t *testing.T, d Transport) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := d.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if err := checkEcho(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// checkEcho writes data to conn and checks that it is read back.
+func checkEcho(conn net.Conn) error {
+	b := []byte("hello")
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	buf := make([]byte, len(b))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(b, buf) {
+		return errors.New("corrupted data")
+	}
+	return nil
+}
+
+func newTestCert(t *testing.T) tls.Certificate {
+	_, _, keyPEM, certPEM, err := GenerateCertificate("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveEcho(l)
+	return l
+}
+
+func serveEcho(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
@@ -1,54 +1,178 @@
 package ctunnel
 
 import (
+	"context"
 	"github.com/IrineSistiana/simple-tls/core/alloc"
+	"github.com/IrineSistiana/simple-tls/core/ratelimit"
 	"github.com/IrineSistiana/simple-tls/core/utils"
+	"go.uber.org/zap"
 	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TunnelOpts struct {
 	IdleTimout time.Duration
+
+	// Logger logs the tunnel events at debug level. Default is a nop logger.
+	Logger *zap.Logger
+
+	// Limiter limits the bandwidth of the tunnel. Bytes of both directions
+	// are taken from it. Nil means no limit.
+	Limiter *ratelimit.Limiter
+
+	// OnStart is called before the tunnel starts copying data.
+	OnStart func()
+	// OnBytes is called with the number of bytes copied in direction d
+	// since its last call. Calls are batched, each direction calls it at
+	// most once per BytesInterval (default 1s) while copying, and once
+	// more when it finishes. It may be called concurrently from both
+	// directions.
+	OnBytes       func(d Direction, n int64)
+	BytesInterval time.Duration
+	// OnClose is called after the tunnel was closed. No OnBytes will be
+	// called after it.
+	OnClose func(r Result)
 }
 
 func (opts *TunnelOpts) init() {
 	utils.SetDefaultNum(&opts.IdleTimout, time.Second*300)
+	utils.SetDefaultNum(&opts.BytesInterval, time.Second)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+}
+
+// Direction is the direction of data in a tunnel.
+type Direction int
+
+const (
+	AToB Direction = iota // from a to b
+	BToA                  // from b to a
+)
+
+func (d Direction) String() string {
+	if d == AToB {
+		return "a_to_b"
+	}
+	return "b_to_a"
+}
+
+// CloseReason tells why a tunnel was closed.
+type CloseReason int
+
+const (
+	// CloseEOF means both sides finished normally.
+	CloseEOF CloseReason = iota
+	// CloseIdleTimeout means no data was transferred within IdleTimout.
+	CloseIdleTimeout
+	// CloseError means an error occurred on one side.
+	CloseError
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseEOF:
+		return "eof"
+	case CloseIdleTimeout:
+		return "idle_timeout"
+	default:
+		return "error"
+	}
+}
+
+// Result is the statistics of a finished tunnel.
+type Result struct {
+	AToB     int64 // bytes copied from a to b
+	BToA     int64 // bytes copied from b to a
+	Start    time.Time
+	Duration time.Duration
+	Reason   CloseReason
+	Err      error // the first err encountered, same as the err returned by OpenTunnel.
 }
 
 // OpenTunnel opens a tunnel between a and b.
-// It returns the first err encountered.
+// It returns the statistics and the first err encountered.
+// If one side reaches EOF and the other side supports CloseWrite (e.g.
+// *net.TCPConn, *tls.Conn), the half-close will be propagated, and the
+// reverse direction keeps working until it finishes or idle timeout.
+// Otherwise, the tunnel will be closed.
 // a and b will be closed by OpenTunnel.
-func OpenTunnel(a, b net.Conn, opts TunnelOpts) error {
+func OpenTunnel(a, b net.Conn, opts TunnelOpts) (Result, error) {
+	opts.init()
 	t := newTunnel(a, b, opts)
-	go func() {
-		_, err := t.copyBuffer(a, b)
-		t.closePeersWithErr(err)
-	}()
-	go func() {
-		_, err := t.copyBuffer(b, a)
-		t.closePeersWithErr(err)
-	}()
-	return t.waitUntilClosed()
+	if opts.OnStart != nil {
+		opts.OnStart()
+	}
+	start := time.Now()
+	t.wg.Add(2)
+	go t.pipe(b, a, AToB)
+	go t.pipe(a, b, BToA)
+	err := t.waitUntilClosed()
+	t.wg.Wait() // Make sure that all bytes were counted.
+
+	r := Result{
+		AToB:     t.written[AToB],
+		BToA:     t.written[BToA],
+		Start:    start,
+		Duration: time.Since(start),
+		Reason:   closeReason(err),
+		Err:      err,
+	}
+	opts.Logger.Debug("tunnel closed",
+		zap.Int64("a_to_b", r.AToB),
+		zap.Int64("b_to_a", r.BToA),
+		zap.Duration("duration", r.Duration),
+		zap.Stringer("reason", r.Reason),
+		zap.NamedError("tunnel_err", err),
+	)
+	if opts.OnClose != nil {
+		opts.OnClose(r)
+	}
+	return r, err
+}
+
+func closeReason(err error) CloseReason {
+	if err == nil {
+		return CloseEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseIdleTimeout
+	}
+	return CloseError
+}
+
+type closeWriter interface {
+	CloseWrite() error
 }
 
 type tunnel struct {
 	a, b net.Conn
 	opts TunnelOpts
 
+	halfClosed int32 // number of directions that were finished by half-close.
+	wg         sync.WaitGroup
+	written    [2]int64 // indexed by Direction, written by pipe.
+
+	ctx    context.Context // canceled when the tunnel was closed.
+	cancel context.CancelFunc
+
 	closeOnce   sync.Once
 	closeNotify chan struct{}
 	closeErr    error
 }
 
 func newTunnel(a, b net.Conn, opts TunnelOpts) *tunnel {
-	return &tunnel{a: a, b: b, opts: opts, closeNotify: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnel{a: a, b: b, opts: opts, ctx: ctx, cancel: cancel, closeNotify: make(chan struct{})}
 }
 
 func (t *tunnel) closePeersWithErr(err error) {
 	t.closeOnce.Do(func() {
+		t.cancel()
 		t.a.Close()
 		t.b.Close()
 		t.closeErr = err
@@ -56,11 +180,21 @@ func (t *tunnel) closePeersWithErr(err error) {
 	})
 }
 
-func (t *tunnel) openOneWayTunnel(dst, src net.Conn) {
-	go func() {
-		_, err := t.copyBuffer(dst, src)
-		t.closePeersWithErr(err)
-	}()
+// pipe copies data from src to dst. When src reaches EOF, pipe tries
+// to half-close dst. The tunnel will be closed if any error occurs, dst
+// does not support half-close, or both directions were half-closed.
+func (t *tunnel) pipe(dst, src net.Conn, d Direction) {
+	defer t.wg.Done()
+	n, err := t.copyBuffer(dst, src, d)
+	t.written[d] = n
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			if atomic.AddInt32(&t.halfClosed, 1) < 2 {
+				return
+			}
+		}
+	}
+	t.closePeersWithErr(err)
 }
 
 func (t *tunnel) waitUntilClosed() error {
@@ -68,14 +202,19 @@ func (t *tunnel) waitUntilClosed() error {
 	return t.closeErr
 }
 
-func (t *tunnel) copyBuffer(dst net.Conn, src net.Conn) (written int64, err error) {
+func (t *tunnel) copyBuffer(dst net.Conn, src net.Conn, d Direction) (written int64, err error) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	var buf []byte
+	var pending int64 // bytes that were not reported to OnBytes.
+	lastReport := time.Now()
 	defer func() {
 		if buf != nil {
 			alloc.ReleaseBuf(buf)
 		}
+		if pending > 0 && t.opts.OnBytes != nil {
+			t.opts.OnBytes(d, pending)
+		}
 	}()
 	for {
 		if buf != nil {
@@ -85,10 +224,21 @@ func (t *tunnel) copyBuffer(dst net.Conn, src net.Conn) (written int64, err erro
 		src.SetDeadline(time.Now().Add(t.opts.IdleTimout))
 		nr, er := src.Read(buf)
 		if nr > 0 {
+			if t.opts.Limiter != nil {
+				if err = t.opts.Limiter.WaitN(t.ctx, nr); err != nil {
+					break
+				}
+			}
 			dst.SetDeadline(time.Now().Add(t.opts.IdleTimout))
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				written += int64(nw)
+				pending += int64(nw)
+				if t.opts.OnBytes != nil && time.Since(lastReport) >= t.opts.BytesInterval {
+					t.opts.OnBytes(d, pending)
+					pending = 0
+					lastReport = time.Now()
+				}
 			}
 			if ew != nil {
 				err = ew
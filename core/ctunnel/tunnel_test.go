@@ -3,8 +3,10 @@ package ctunnel
 import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,7 +32,18 @@ func TestOpenTunnel_IO(t *testing.T) {
 		c01.Close()
 	}()
 
-	err := OpenTunnel(c02, c11, TunnelOpts{IdleTimout: time.Second})
+	var started, closed bool
+	var reported int64
+	res, err := OpenTunnel(c02, c11, TunnelOpts{
+		IdleTimout: time.Second,
+		OnStart:    func() { started = true },
+		OnBytes: func(d Direction, n int64) {
+			if d == AToB {
+				atomic.AddInt64(&reported, n)
+			}
+		},
+		OnClose: func(r Result) { closed = true },
+	})
 	if err != nil {
 		t.Error(err)
 	}
@@ -38,6 +51,11 @@ func TestOpenTunnel_IO(t *testing.T) {
 	if !bytes.Equal(data, readBuf.Bytes()) {
 		t.Error("data broken")
 	}
+	assert.True(t, started && closed, "hooks were not called")
+	assert.Equal(t, int64(len(data)), res.AToB)
+	assert.Equal(t, int64(0), res.BToA)
+	assert.Equal(t, res.AToB, atomic.LoadInt64(&reported))
+	assert.Equal(t, CloseEOF, res.Reason)
 }
 
 func TestOpenTunnel_Timeout(t *testing.T) {
@@ -45,9 +63,64 @@ func TestOpenTunnel_Timeout(t *testing.T) {
 	c11, _ := net.Pipe()
 
 	start := time.Now()
-	err := OpenTunnel(c02, c11, TunnelOpts{IdleTimout: time.Millisecond * 50})
+	res, err := OpenTunnel(c02, c11, TunnelOpts{IdleTimout: time.Millisecond * 50})
 	assert.WithinDuration(t, start, time.Now(), time.Millisecond*200, "timeout takes too long")
 	if err == nil {
 		t.Error("want a timeout err, but got nil")
 	}
+	assert.Equal(t, CloseIdleTimeout, res.Reason)
+}
+
+func TestOpenTunnel_HalfClose(t *testing.T) {
+	tcpPipe := func() (*net.TCPConn, *net.TCPConn) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		c1, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c1.(*net.TCPConn), c2.(*net.TCPConn)
+	}
+
+	client, a := tcpPipe()
+	b, server := tcpPipe()
+	defer client.Close()
+	defer server.Close()
+
+	tunnelErr := make(chan error, 1)
+	go func() {
+		_, err := OpenTunnel(a, b, TunnelOpts{IdleTimout: time.Second})
+		tunnelErr <- err
+	}()
+
+	// server reads until EOF, then responds.
+	go func() {
+		defer server.Close()
+		req, err := io.ReadAll(server)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server.Write(append([]byte("re: "), req...))
+	}()
+
+	client.Write([]byte("ping"))
+	client.CloseWrite()
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "re: ping" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+	if err := <-tunnelErr; err != nil {
+		t.Fatal(err)
+	}
 }
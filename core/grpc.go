@@ -3,25 +3,60 @@ package core
 import (
 	"github.com/IrineSistiana/simple-tls/core/grpc_lb"
 	"github.com/IrineSistiana/simple-tls/core/grpc_tunnel"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type grpcServerHandler struct {
 	connHandler TransportHandler
+	logger      connLogger
+	route       string
+	limiter     *connLimiter // limits streams, can be nil.
 
 	grpc_tunnel.UnimplementedGRPCTunnelServer
 }
 
-func newGrpcServerHandler(connHandler TransportHandler) *grpcServerHandler {
+func newGrpcServerHandler(connHandler TransportHandler, logger connLogger, route string, limiter *connLimiter) *grpcServerHandler {
 	return &grpcServerHandler{
 		connHandler: connHandler,
+		logger:      logger,
+		route:       route,
+		limiter:     limiter,
 	}
 }
 
 func (g grpcServerHandler) Connect(stream grpc_tunnel.GRPCTunnel_ConnectServer) error {
-	err := g.connHandler.Handle(grpc_lb.NewGrpcPeerConn(stream))
+	if g.limiter != nil {
+		var ip string
+		if p, ok := peer.FromContext(stream.Context()); ok {
+			ip, _ = peerIP(p.Addr)
+		}
+		if err := g.limiter.acquire(ip, g.route); err != nil {
+			g.logger.errLog.Warn("stream rejected", zap.String("ip", ip), zap.String("route", g.route), zap.Error(err))
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		defer g.limiter.release(ip, g.route)
+	}
+
+	conn := grpc_lb.NewGrpcPeerConn(stream)
+	defer conn.Close()
+	cl := g.logger.forConn(conn)
+	cl.l.Debug("new stream")
+	ctx := withConnLogger(stream.Context(), cl)
+	if p, ok := peer.FromContext(ctx); ok {
+		switch info := p.AuthInfo.(type) {
+		case serverTLSInfo:
+			ctx = withTLSState(ctx, info.State)
+		case credentials.TLSInfo:
+			ctx = withTLSState(ctx, info.State)
+		}
+	}
+	err := g.connHandler.Handle(ctx, conn)
 	if err != nil {
+		cl.logConnErr("handler err", err)
 		return status.Error(codes.Internal, err.Error())
 	}
 	return nil
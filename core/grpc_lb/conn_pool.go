@@ -2,6 +2,7 @@ package grpc_lb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/IrineSistiana/simple-tls/core/grpc_tunnel"
 	"go.uber.org/zap"
@@ -15,16 +16,24 @@ import (
 const (
 	DefaultMaxStreamPreConn = 4
 	CCIdleTimeout           = time.Second * 60
+
+	// streamLinger is the maximum time to wait for the server to finish
+	// a stream after the conn was closed. After that, the stream will
+	// be canceled.
+	streamLinger = time.Second * 5
 )
 
 type ConnPool struct {
 	opts ConnPoolOpts
 
 	m       sync.Mutex
+	closed  bool
 	readyCc map[*grpc.ClientConn]*connStatus
 	busyCc  map[*grpc.ClientConn]*connStatus
 }
 
+var ErrPoolClosed = errors.New("conn pool closed")
+
 func NewConnPool(opts ConnPoolOpts) *ConnPool {
 	opts.init()
 	return &ConnPool{
@@ -84,10 +93,11 @@ func (p *ConnPool) GetConn(ctx context.Context) (net.Conn, error) {
 	stream, err := grpcClient.Connect(rpcCtx)
 	close(dialDone)
 	if err != nil {
+		cancel()
 		p.ccStreamDone(cc)
 		return nil, err
 	}
-	return wrapCC(stream, p, cc), nil
+	return wrapCC(stream, p, cc, cancel), nil
 }
 
 // getCc retrieves a *grpc.ClientConn from pool or dials a new one.
@@ -96,6 +106,10 @@ func (p *ConnPool) getCc() (*grpc.ClientConn, error) {
 	p.m.Lock()
 	defer p.m.Unlock()
 
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
 	var pickedCc *grpc.ClientConn
 	for cc, status := range p.readyCc {
 		if status.ongoingStream == 0 { // an idled cc
@@ -170,32 +184,62 @@ func (p *ConnPool) streamDoneUpdateStatusLocked(cc *grpc.ClientConn, s *connStat
 	}
 }
 
+// Close closes all client conns in the pool. Their streams will
+// be canceled. Further GetConn calls will return ErrPoolClosed.
+func (p *ConnPool) Close() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.closed = true
+	for _, group := range [...]map[*grpc.ClientConn]*connStatus{p.readyCc, p.busyCc} {
+		for cc, status := range group {
+			if status.idleTimer != nil {
+				status.idleTimer.Stop()
+			}
+			_ = cc.Close()
+			delete(group, cc)
+		}
+	}
+}
+
 // dialNewCc dials a new *grpc.ClientConn. This must not be blocked.
 func (p *ConnPool) dialNewCc() (*grpc.ClientConn, error) {
 	return grpc.Dial(p.opts.Target, p.opts.DialOpts...)
 }
 
-// releaseStreamConn automatically releases cc to ConnPool when its
-// Close is called.
+// releaseStreamConn automatically finishes the stream and releases cc
+// to ConnPool when its Close is called.
 type releaseStreamConn struct {
-	net.Conn
-	p  *ConnPool
-	cc *grpc.ClientConn
+	*GrpcPeerRWCWrapper
+	p      *ConnPool
+	cc     *grpc.ClientConn
+	cancel context.CancelFunc
 
 	releaseOnce sync.Once
 }
 
-func wrapCC(stream grpc_tunnel.TunnelPeer, p *ConnPool, cc *grpc.ClientConn) net.Conn {
+func wrapCC(stream grpc_tunnel.TunnelPeer, p *ConnPool, cc *grpc.ClientConn, cancel context.CancelFunc) net.Conn {
 	return &releaseStreamConn{
-		Conn: NewGrpcPeerConn(stream),
-		p:    p,
-		cc:   cc,
+		GrpcPeerRWCWrapper: newGrpcPeerConn(stream),
+		p:                  p,
+		cc:                 cc,
+		cancel:             cancel,
 	}
 }
 
 func (r *releaseStreamConn) Close() error {
+	err := r.GrpcPeerRWCWrapper.Close()
 	r.releaseOnce.Do(func() {
-		r.p.ccStreamDone(r.cc)
+		go func() {
+			t := time.NewTimer(streamLinger)
+			defer t.Stop()
+			select {
+			case <-r.recvDone:
+			case <-t.C:
+			}
+			r.cancel()
+			r.p.ccStreamDone(r.cc)
+		}()
 	})
-	return r.Conn.Close()
+	return err
 }
@@ -2,6 +2,7 @@ package grpc_lb
 
 import (
 	"bytes"
+	"errors"
 	"github.com/IrineSistiana/simple-tls/core/alloc"
 	"github.com/IrineSistiana/simple-tls/core/grpc_tunnel"
 	"google.golang.org/grpc/peer"
@@ -13,8 +14,9 @@ import (
 )
 
 type GrpcPeerRWCWrapper struct {
-	stream   grpc_tunnel.TunnelPeer
-	peerAddr net.Addr
+	stream    grpc_tunnel.TunnelPeer
+	peerAddr  net.Addr
+	localAddr net.Addr
 
 	rm      sync.Mutex
 	readBuf *bytes.Buffer
@@ -28,64 +30,131 @@ type GrpcPeerRWCWrapper struct {
 	closeOnce   sync.Once
 	closeNotify chan struct{}
 	closeErr    error // closeErr will be set before closeNotify was closed.
+
+	readEOF  chan struct{} // closed when the peer closed its write side.
+	recvDone chan struct{} // closed when stream.Recv returned an error.
+	isClient bool
 }
 
 type writeCmd struct {
 	buf []byte     // buf is managed by Allocator.
+	fin bool       // closes the write side, buf is unused.
 	err chan error // a chan to receive grpc Send() result.
 }
 
+var errWriteClosed = errors.New("write side was closed")
+
 func NewGrpcPeerConn(s grpc_tunnel.TunnelPeer) net.Conn {
+	return newGrpcPeerConn(s)
+}
+
+func newGrpcPeerConn(s grpc_tunnel.TunnelPeer) *GrpcPeerRWCWrapper {
 	p, ok := peer.FromContext(s.Context())
-	var addr net.Addr
+	var addr, localAddr net.Addr = grpcPeerAddrUnavailable{}, grpcPeerAddrUnavailable{}
 	if ok {
 		addr = p.Addr
-	} else {
-		addr = grpcPeerAddrUnavailable{}
+		// The local address is only available if the transport
+		// credentials report it in the AuthInfo.
+		if la, ok := p.AuthInfo.(interface{ LocalAddr() net.Addr }); ok && la.LocalAddr() != nil {
+			localAddr = la.LocalAddr()
+		}
 	}
 	c := &GrpcPeerRWCWrapper{
 		stream:        s,
 		peerAddr:      addr,
+		localAddr:     localAddr,
 		readChan:      make(chan []byte),
 		writeBufChan:  make(chan writeCmd),
 		readDeadline:  makePipeDeadline(),
 		writeDeadline: makePipeDeadline(),
 		closeNotify:   make(chan struct{}),
+		readEOF:       make(chan struct{}),
+		recvDone:      make(chan struct{}),
 	}
+	_, c.isClient = s.(interface{ CloseSend() error })
 	go c.readLoop()
 	go c.writeLoop()
 	return c
 }
 
+// readLoop receives messages from the stream.
+// The half-close of the peer is signaled by:
+// client -> server: CloseSend, Recv returns io.EOF on server side.
+// server -> client: an empty message. The server cannot end the stream
+// without ending the rpc.
 func (g *GrpcPeerRWCWrapper) readLoop() {
+	defer close(g.recvDone)
 	for {
 		m, err := g.stream.Recv()
 		if err != nil {
+			if err == io.EOF && !g.isClient {
+				close(g.readEOF)
+				return
+			}
 			g.closeWithErr(err)
 			return
 		}
+		if len(m.B) == 0 {
+			if !isClosedChan(g.readEOF) {
+				close(g.readEOF)
+			}
+			continue
+		}
+		if isClosedChan(g.readEOF) {
+			continue // Peer should not send anything after its half-close.
+		}
 		select {
 		case g.readChan <- m.B:
 		case <-g.closeNotify:
-			return
+			// Keep receiving until the stream is finished. So the
+			// stream won't leak.
+			for {
+				if _, err := g.stream.Recv(); err != nil {
+					return
+				}
+			}
 		}
 	}
 }
 
 func (g *GrpcPeerRWCWrapper) writeLoop() {
 	msg := &grpc_tunnel.Bytes{}
+	writeClosed := false
 	for {
 		select {
 		case cmd := <-g.writeBufChan:
-			msg.B = cmd.buf
-			err := g.stream.Send(msg)
-			alloc.ReleaseBuf(cmd.buf)
+			var err error
+			switch {
+			case writeClosed:
+				if !cmd.fin {
+					alloc.ReleaseBuf(cmd.buf)
+					err = errWriteClosed
+				}
+				cmd.err <- err
+				continue
+			case cmd.fin:
+				writeClosed = true
+				if g.isClient {
+					err = g.stream.(interface{ CloseSend() error }).CloseSend()
+				} else {
+					msg.B = nil
+					err = g.stream.Send(msg)
+				}
+			default:
+				msg.B = cmd.buf
+				err = g.stream.Send(msg)
+				alloc.ReleaseBuf(cmd.buf)
+			}
 			cmd.err <- err
 			if err != nil {
 				g.closeWithErr(err)
 				return
 			}
 		case <-g.closeNotify:
+			// Client stream only. Tell the server that we are done.
+			if cs, ok := g.stream.(interface{ CloseSend() error }); ok {
+				_ = cs.CloseSend()
+			}
 			return
 		}
 	}
@@ -107,7 +176,7 @@ func (g *GrpcPeerRWCWrapper) Read(p []byte) (n int, err error) {
 	}
 
 	switch {
-	case isClosedChan(g.closeNotify):
+	case isClosedChan(g.closeNotify), isClosedChan(g.readEOF):
 		return 0, io.EOF
 	case isClosedChan(g.readDeadline.wait()):
 		return 0, os.ErrDeadlineExceeded
@@ -117,6 +186,8 @@ func (g *GrpcPeerRWCWrapper) Read(p []byte) (n int, err error) {
 	case b := <-g.readChan:
 		g.readBuf = bytes.NewBuffer(b)
 		return g.readBuf.Read(p)
+	case <-g.readEOF:
+		return 0, io.EOF
 	case <-g.readDeadline.wait():
 		return 0, os.ErrDeadlineExceeded
 	case <-g.closeNotify:
@@ -132,6 +203,11 @@ func (g *GrpcPeerRWCWrapper) Write(p []byte) (n int, err error) {
 		return 0, os.ErrDeadlineExceeded
 	}
 
+	// An empty message is the half-close signal from server.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
 	// async write, p cannot be directly used.
 	buf := alloc.GetBuf(len(p))
 	copy(buf, p)
@@ -154,13 +230,28 @@ func (g *GrpcPeerRWCWrapper) Write(p []byte) (n int, err error) {
 	}
 }
 
+// CloseWrite closes the write side of the stream. The peer will read
+// io.EOF after all data was read. Reads are not affected.
+func (g *GrpcPeerRWCWrapper) CloseWrite() error {
+	cmd := writeCmd{
+		fin: true,
+		err: make(chan error),
+	}
+	select {
+	case g.writeBufChan <- cmd:
+		return <-cmd.err
+	case <-g.closeNotify:
+		return g.closeErr
+	}
+}
+
 func (g *GrpcPeerRWCWrapper) Close() error {
 	g.closeWithErr(os.ErrClosed)
 	return nil
 }
 
 func (g *GrpcPeerRWCWrapper) LocalAddr() net.Addr {
-	return grpcPeerAddrUnavailable{}
+	return g.localAddr
 }
 
 func (g *GrpcPeerRWCWrapper) RemoteAddr() net.Addr {
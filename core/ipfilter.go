@@ -0,0 +1,218 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/IrineSistiana/simple-tls/core/ratelimit"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// IPFilter checks the source IPs of conns against CIDR allow and deny lists.
+// An IP is denied if it matches the deny list, or the allow list is not
+// empty and the IP does not match it. Addresses that have no IP (e.g.
+// unix sockets) are always allowed.
+// IPFilter is safe for concurrent use. Its lists can be changed at runtime.
+type IPFilter struct {
+	allowFile, denyFile string
+
+	m     sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	denied    uint64            // atomic
+	logBucket *ratelimit.Bucket // limits the logs of denied conns.
+}
+
+// NewIPFilter returns an IPFilter with the given lists. Entries can be
+// CIDRs or IPs.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{logBucket: ratelimit.NewBucket(1, 10)}
+	if err := f.Set(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// LoadIPFilter returns an IPFilter with the lists from files. Either file
+// can be empty. A file has one CIDR or IP per line, lines starting with
+// '#' are comments. Use IPFilter.Reload to reload the files.
+func LoadIPFilter(allowFile, denyFile string) (*IPFilter, error) {
+	f := &IPFilter{allowFile: allowFile, denyFile: denyFile, logBucket: ratelimit.NewBucket(1, 10)}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reloads the lists from files. If an error occurs, current lists
+// are kept.
+func (f *IPFilter) Reload() error {
+	allow, err := readIPList(f.allowFile)
+	if err != nil {
+		return fmt.Errorf("failed to load allow list: %w", err)
+	}
+	deny, err := readIPList(f.denyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load deny list: %w", err)
+	}
+	return f.Set(allow, deny)
+}
+
+// Set replaces the lists.
+func (f *IPFilter) Set(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.allow = allowNets
+	f.deny = denyNets
+	return nil
+}
+
+// Allow reports whether addr is allowed.
+func (f *IPFilter) Allow(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// Denied returns the number of conns that were denied by the listeners
+// from f.Listener.
+func (f *IPFilter) Denied() uint64 {
+	return atomic.LoadUint64(&f.denied)
+}
+
+// Listener returns a listener that closes the accepted conns whose remote
+// addresses are denied by f. Denied conns are logged by logger (at most
+// once per second). If logger is nil, the global logger will be used.
+func (f *IPFilter) Listener(l net.Listener, logger *zap.Logger) net.Listener {
+	return &filterListener{Listener: l, f: f, logger: newConnLogger(logger, "")}
+}
+
+func (f *IPFilter) listener(l net.Listener, logger connLogger) net.Listener {
+	if f == nil {
+		return l
+	}
+	return &filterListener{Listener: l, f: f, logger: logger}
+}
+
+type filterListener struct {
+	net.Listener
+	f      *IPFilter
+	logger connLogger
+}
+
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.f.Allow(c.RemoteAddr()) {
+			return c, nil
+		}
+		n := atomic.AddUint64(&l.f.denied, 1)
+		if l.f.logBucket.Allow() {
+			l.logger.l.Warn("conn denied by ip filter", zap.Stringer("remote", c.RemoteAddr()), zap.Uint64("denied_total", n))
+		}
+		_ = c.Close()
+	}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(s []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(s))
+	for _, e := range s {
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip [%s]", e)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// readIPList reads entries from file. It returns nil if file is empty.
+func readIPList(file string) ([]string, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s = append(s, line)
+	}
+	return s, scanner.Err()
+}
@@ -0,0 +1,57 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_IPFilter(t *testing.T) {
+	dir := t.TempDir()
+	allowFile := filepath.Join(dir, "allow")
+	denyFile := filepath.Join(dir, "deny")
+	os.WriteFile(allowFile, []byte("# lan\n10.0.0.0/8\n::1\n"), 0644)
+	os.WriteFile(denyFile, []byte("10.0.0.1\n"), 0644)
+
+	f, err := LoadIPFilter(allowFile, denyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := func(s string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(s)} }
+	for ip, want := range map[string]bool{
+		"10.1.2.3":  true,
+		"10.0.0.1":  false, // deny wins.
+		"::1":       true,
+		"192.0.2.1": false, // not in the allow list.
+	} {
+		if got := f.Allow(addr(ip)); got != want {
+			t.Errorf("%s: want %v, got %v", ip, want, got)
+		}
+	}
+
+	os.WriteFile(allowFile, nil, 0644)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Allow(addr("192.0.2.1")) {
+		t.Error("empty allow list should allow all")
+	}
+}
@@ -0,0 +1,96 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"net"
+	"sync"
+)
+
+// lifecycle tracks the listeners and tunnels of a Server or a Client.
+type lifecycle struct {
+	m         sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	addr      net.Addr
+	ready     chan struct{}
+
+	tunnels connGroup
+}
+
+// readyChan returns a chan that is closed when the first listener was added.
+func (lc *lifecycle) readyChan() <-chan struct{} {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	return lc.readyChanLocked()
+}
+
+func (lc *lifecycle) readyChanLocked() chan struct{} {
+	if lc.ready == nil {
+		lc.ready = make(chan struct{})
+	}
+	return lc.ready
+}
+
+// listenAddr returns the address of the first added listener.
+// It returns nil if no listener was added.
+func (lc *lifecycle) listenAddr() net.Addr {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	return lc.addr
+}
+
+// addListener adds l to lc. It returns false if lc was closed.
+func (lc *lifecycle) addListener(l net.Listener) bool {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	if lc.closed {
+		return false
+	}
+	if lc.listeners == nil {
+		lc.listeners = make(map[net.Listener]struct{})
+	}
+	lc.listeners[l] = struct{}{}
+	if lc.addr == nil {
+		lc.addr = l.Addr()
+		close(lc.readyChanLocked())
+	}
+	return true
+}
+
+func (lc *lifecycle) removeListener(l net.Listener) {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	delete(lc.listeners, l)
+}
+
+func (lc *lifecycle) isClosed() bool {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	return lc.closed
+}
+
+// close marks lc as closed and closes all its listeners.
+func (lc *lifecycle) close() {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	lc.closed = true
+	for l := range lc.listeners {
+		_ = l.Close()
+	}
+}
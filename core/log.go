@@ -0,0 +1,84 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"github.com/IrineSistiana/simple-tls/core/mlog"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+)
+
+// connLogger holds the loggers of an instance or a tunnel.
+type connLogger struct {
+	l      *zap.Logger
+	errLog *zap.Logger // for repetitive conn errors, it may be sampled.
+}
+
+// newConnLogger returns a connLogger from user's logger. If l is nil,
+// the global logger from mlog will be used. If name is not empty, loggers
+// will be named with it.
+func newConnLogger(l *zap.Logger, name string) connLogger {
+	cl := connLogger{l: l, errLog: l}
+	if l == nil {
+		cl = connLogger{l: mlog.L(), errLog: mlog.ConnErrL()}
+	}
+	if len(name) > 0 {
+		cl.l = cl.l.Named(name)
+		cl.errLog = cl.errLog.Named(name)
+	}
+	return cl
+}
+
+func (cl connLogger) with(fields ...zap.Field) connLogger {
+	return connLogger{l: cl.l.With(fields...), errLog: cl.errLog.With(fields...)}
+}
+
+var connIDCounter uint64
+
+// forConn returns a connLogger tagged with a new conn id and the
+// remote address of conn.
+func (cl connLogger) forConn(conn net.Conn) connLogger {
+	return cl.with(zap.Uint64("conn_id", atomic.AddUint64(&connIDCounter, 1)), zap.Stringer("remote", conn.RemoteAddr()))
+}
+
+func (cl connLogger) logConnErr(msg string, err error) {
+	cl.errLog.Error(msg, zap.Error(err))
+}
+
+type loggerCtxKey struct{}
+
+func withConnLogger(ctx context.Context, cl connLogger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey{}, cl)
+}
+
+func connLoggerFromContext(ctx context.Context) connLogger {
+	cl, ok := ctx.Value(loggerCtxKey{}).(connLogger)
+	if !ok {
+		return newConnLogger(nil, "")
+	}
+	return cl
+}
+
+// LoggerFromContext returns the logger of the tunnel. Its entries are
+// tagged with the instance name, the route, the conn id and the remote
+// address of the tunnel.
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	return connLoggerFromContext(ctx).l
+}
@@ -0,0 +1,198 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/simple-tls/core/ctunnel"
+	"github.com/IrineSistiana/simple-tls/core/ratelimit"
+	"go.uber.org/zap"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TransportHandlerFunc is an adapter to use a func as a TransportHandler.
+type TransportHandlerFunc func(ctx context.Context, conn net.Conn) error
+
+func (f TransportHandlerFunc) Handle(ctx context.Context, conn net.Conn) error {
+	return f(ctx, conn)
+}
+
+// Middleware wraps a TransportHandler.
+type Middleware func(next TransportHandler) TransportHandler
+
+// Chain wraps h with mws. The first middleware is the outermost one,
+// which handles the conn first.
+func Chain(h TransportHandler, mws ...Middleware) TransportHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+type routeCtxKey struct{}
+
+// RouteFromContext returns the route name of the tunnel. In grpc mode,
+// it is the grpc service name. In raw tls mode, it is always "".
+func RouteFromContext(ctx context.Context) string {
+	s, _ := ctx.Value(routeCtxKey{}).(string)
+	return s
+}
+
+// withRoute returns a handler that adds the route name to ctx and
+// the logger in ctx.
+func withRoute(route string, next TransportHandler) TransportHandler {
+	return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		ctx = context.WithValue(ctx, routeCtxKey{}, route)
+		ctx = withConnLogger(ctx, connLoggerFromContext(ctx).with(zap.String("route", route)))
+		return next.Handle(ctx, conn)
+	})
+}
+
+var (
+	ErrTooManyConns = errors.New("too many connections")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrRejected     = errors.New("connection rejected")
+)
+
+// AccessLog logs every tunnel when it is closed. If logger is nil,
+// the logger of the tunnel will be used, see LoggerFromContext.
+// If the tunnel was opened by DstTransportHandler, the transferred bytes
+// will also be logged.
+func AccessLog(logger *zap.Logger) Middleware {
+	return func(next TransportHandler) TransportHandler {
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			start := time.Now()
+			var res *ctunnel.Result
+			ctx = WithTunnelHooks(ctx, TunnelHooks{OnClose: func(r ctunnel.Result) { res = &r }})
+			err := next.Handle(ctx, conn)
+			l := logger
+			if l == nil {
+				l = LoggerFromContext(ctx)
+			} else {
+				l = l.With(zap.String("route", RouteFromContext(ctx)), zap.Stringer("remote", conn.RemoteAddr()))
+			}
+			fields := []zap.Field{zap.Duration("duration", time.Since(start)), zap.NamedError("tunnel_err", err)}
+			if res != nil {
+				fields = append(fields, zap.Int64("bytes_up", res.AToB), zap.Int64("bytes_down", res.BToA), zap.Stringer("reason", res.Reason))
+			}
+			l.Info("tunnel closed", fields...)
+			return err
+		})
+	}
+}
+
+// MaxConns limits the number of concurrent tunnels to n. Tunnels that
+// exceed the limit will be rejected with ErrTooManyConns.
+func MaxConns(n int) Middleware {
+	return func(next TransportHandler) TransportHandler {
+		var active int32
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			defer atomic.AddInt32(&active, -1)
+			if atomic.AddInt32(&active, 1) > int32(n) {
+				return ErrTooManyConns
+			}
+			return next.Handle(ctx, conn)
+		})
+	}
+}
+
+// RateLimit limits the rate of new tunnels to r per second with
+// burst b. Tunnels that exceed the limit will be rejected with ErrRateLimited.
+func RateLimit(r float64, b int) Middleware {
+	return func(next TransportHandler) TransportHandler {
+		bucket := ratelimit.NewBucket(r, b)
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			if !bucket.Allow() {
+				return ErrRateLimited
+			}
+			return next.Handle(ctx, conn)
+		})
+	}
+}
+
+// RemoteFilter rejects tunnels whose remote address is not allowed by
+// allow with ErrRejected.
+func RemoteFilter(allow func(addr net.Addr) bool) Middleware {
+	return func(next TransportHandler) TransportHandler {
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			if !allow(conn.RemoteAddr()) {
+				return ErrRejected
+			}
+			return next.Handle(ctx, conn)
+		})
+	}
+}
+
+// Sniff peeks at most n bytes from the beginning of the tunnel (waits
+// at most timeout) and passes them to route. If route returns a non-nil
+// handler, the tunnel will be handled by it instead of the next handler.
+// The peeked bytes are still readable by the handler.
+// It can be used for protocol detection and custom routing.
+func Sniff(n int, timeout time.Duration, route func(ctx context.Context, prefix []byte) TransportHandler) Middleware {
+	return func(next TransportHandler) TransportHandler {
+		return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			pc := &prefixConn{Conn: conn, prefix: make([]byte, n)}
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			read := 0
+			for read < n {
+				nr, err := conn.Read(pc.prefix[read:])
+				read += nr
+				if err != nil {
+					if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+						pc.err = err
+					}
+					break
+				}
+			}
+			conn.SetReadDeadline(time.Time{})
+			pc.prefix = pc.prefix[:read]
+
+			if h := route(ctx, pc.prefix); h != nil {
+				return h.Handle(ctx, pc)
+			}
+			return next.Handle(ctx, pc)
+		})
+	}
+}
+
+// prefixConn is a net.Conn that reads prefix first. If err is not nil,
+// it will be returned after prefix was read.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+	err    error
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
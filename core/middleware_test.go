@@ -0,0 +1,88 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Chain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next TransportHandler) TransportHandler {
+			return TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+				order = append(order, name)
+				return next.Handle(ctx, conn)
+			})
+		}
+	}
+	h := Chain(TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		order = append(order, "handler")
+		return nil
+	}), mw("a"), mw("b"))
+	h.Handle(context.Background(), nil)
+	if want := "a,b,handler"; strings.Join(order, ",") != want {
+		t.Fatalf("want %s, got %s", want, strings.Join(order, ","))
+	}
+}
+
+func Test_Sniff(t *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\n")
+	for _, short := range [...]bool{false, true} {
+		c1, c2 := net.Pipe()
+		go func() {
+			if short {
+				c1.Write(data[:2]) // less than the sniff size.
+			} else {
+				c1.Write(data)
+			}
+			c1.Close()
+		}()
+
+		var sniffed []byte
+		var got []byte
+		httpHandler := TransportHandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			b, err := io.ReadAll(conn)
+			got = b
+			return err
+		})
+		h := Chain(httpHandler, Sniff(4, time.Millisecond*50, func(ctx context.Context, prefix []byte) TransportHandler {
+			sniffed = append([]byte(nil), prefix...)
+			return nil
+		}))
+		if err := h.Handle(context.Background(), c2); err != nil {
+			t.Fatal(err)
+		}
+		want := data
+		if short {
+			want = data[:2]
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("short %v: want %q, got %q", short, want, got)
+		}
+		if !bytes.HasPrefix(data, sniffed) || len(sniffed) == 0 {
+			t.Fatalf("short %v: invalid sniffed prefix %q", short, sniffed)
+		}
+	}
+}
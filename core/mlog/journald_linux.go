@@ -0,0 +1,91 @@
+//go:build linux
+
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"strconv"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink sends entries to systemd-journald using its native protocol.
+// See https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journaldSink struct {
+	c *net.UnixConn
+}
+
+func newJournaldSink() (leveledSink, error) {
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{c: c}, nil
+}
+
+func (s *journaldSink) write(lvl zapcore.Level, msg []byte) error {
+	b := new(bytes.Buffer)
+	writeJournalField(b, "PRIORITY", []byte(strconv.Itoa(journalPriority(lvl))))
+	writeJournalField(b, "SYSLOG_IDENTIFIER", []byte("simple-tls"))
+	writeJournalField(b, "MESSAGE", msg)
+	_, err := s.c.Write(b.Bytes())
+	return err
+}
+
+func writeJournalField(b *bytes.Buffer, k string, v []byte) {
+	b.WriteString(k)
+	if bytes.IndexByte(v, '\n') < 0 {
+		b.WriteByte('=')
+		b.Write(v)
+		b.WriteByte('\n')
+		return
+	}
+	// Multi-line values use the binary format.
+	b.WriteByte('\n')
+	l := make([]byte, 8)
+	binary.LittleEndian.PutUint64(l, uint64(len(v)))
+	b.Write(l)
+	b.Write(v)
+	b.WriteByte('\n')
+}
+
+func journalPriority(lvl zapcore.Level) int {
+	switch lvl {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	case zapcore.DPanicLevel, zapcore.PanicLevel:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func (s *journaldSink) sync() error {
+	return nil
+}
@@ -18,30 +18,138 @@
 package mlog
 
 import (
+	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 func LogConnErr(msg string, conn net.Conn, err error) {
-	logger.Error(msg, zap.Stringer("remote", conn.RemoteAddr()), zap.Stringer("local", conn.LocalAddr()), zap.Error(err))
+	connErrLogger.Error(msg, zap.Stringer("remote", conn.RemoteAddr()), zap.Stringer("local", conn.LocalAddr()), zap.Error(err))
 }
 
 var logLvl = zap.NewAtomicLevelAt(zap.InfoLevel)
 
-var logger = initLogger()
+var (
+	mainCore    = new(atomic.Value) // *swapTarget
+	connErrCore = new(atomic.Value) // *swapTarget, mainCore with a sampler.
+)
+
+var (
+	logger        = zap.New(&swapCore{p: mainCore})
+	connErrLogger = zap.New(&swapCore{p: connErrCore})
+)
+
+func init() {
+	c := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig()), zapcore.Lock(os.Stderr), logLvl)
+	mainCore.Store(&swapTarget{core: c})
+	connErrCore.Store(&swapTarget{core: c})
+}
 
 func L() *zap.Logger {
 	return logger
 }
 
+// ConnErrL returns the logger that is used by LogConnErr. It is L() with
+// sampling, see Options.SampleFirst.
+func ConnErrL() *zap.Logger {
+	return connErrLogger
+}
+
 func SetLvl(l zapcore.Level) {
 	logLvl.SetLevel(l)
 }
 
-func initLogger() *zap.Logger {
-	ec := zapcore.EncoderConfig{
+// Options configures the output of the global logger.
+type Options struct {
+	// Format is the encoding of log entries. "console" (default) or "json".
+	Format string
+
+	// File is the log file path. If File and Syslog are both empty,
+	// logs are written to stderr.
+	File string
+	// MaxSize is the maximum size in megabytes of the log file before it gets rotated.
+	// Zero disables size based rotation.
+	MaxSize int
+	// RotateInterval rotates the log file periodically.
+	// Zero disables time based rotation.
+	RotateInterval time.Duration
+	// MaxBackups is the maximum number of rotated files to retain.
+	// Zero retains all files.
+	MaxBackups int
+	// MaxAge is the maximum time to retain rotated files.
+	// Zero retains all files.
+	MaxAge time.Duration
+
+	// Syslog is the syslog target. It can be "local" (local syslog daemon),
+	// "journald" (systemd journal native protocol), "udp://host:port",
+	// "tcp://host:port" or "unix:///path/to/socket".
+	Syslog string
+
+	// SampleFirst and SampleThereafter rate-limit repetitive connection
+	// error logs (see LogConnErr). Within every SampleTick (default 1s),
+	// the first SampleFirst entries with the same message are logged,
+	// then only every SampleThereafter-th entry.
+	// SampleFirst <= 0 disables sampling.
+	SampleFirst      int
+	SampleThereafter int
+	SampleTick       time.Duration
+}
+
+// Init rebuilds the global logger from opts. Loggers that were derived
+// from L() before Init will also use the new output.
+func Init(opts Options) error {
+	var enc zapcore.Encoder
+	switch opts.Format {
+	case "", "console":
+		enc = zapcore.NewConsoleEncoder(encoderConfig())
+	case "json":
+		enc = zapcore.NewJSONEncoder(encoderConfig())
+	default:
+		return fmt.Errorf("unknown log format [%s]", opts.Format)
+	}
+
+	var cores []zapcore.Core
+	if len(opts.File) > 0 {
+		w, err := newRotateWriter(opts.File, int64(opts.MaxSize)*1024*1024, opts.RotateInterval, opts.MaxBackups, opts.MaxAge)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %w", err)
+		}
+		cores = append(cores, zapcore.NewCore(enc, zapcore.Lock(w), logLvl))
+	}
+	if len(opts.Syslog) > 0 {
+		sink, err := newLeveledSink(opts.Syslog)
+		if err != nil {
+			return fmt.Errorf("failed to open syslog: %w", err)
+		}
+		cores = append(cores, newLeveledCore(sinkEncoder(opts.Format), sink, logLvl))
+	}
+	if len(cores) == 0 {
+		cores = append(cores, zapcore.NewCore(enc, zapcore.Lock(os.Stderr), logLvl))
+	}
+
+	c := zapcore.NewTee(cores...)
+	connC := c
+	if opts.SampleFirst > 0 {
+		tick := opts.SampleTick
+		if tick <= 0 {
+			tick = time.Second
+		}
+		connC = zapcore.NewSamplerWithOptions(c, tick, opts.SampleFirst, opts.SampleThereafter)
+	}
+
+	old := mainCore.Load().(*swapTarget).core
+	mainCore.Store(&swapTarget{core: c})
+	connErrCore.Store(&swapTarget{core: connC})
+	_ = old.Sync()
+	return nil
+}
+
+func encoderConfig() zapcore.EncoderConfig {
+	return zapcore.EncoderConfig{
 		TimeKey:        "time",
 		MessageKey:     "msg",
 		LevelKey:       "level",
@@ -52,7 +160,76 @@ func initLogger() *zap.Logger {
 		EncodeDuration: zapcore.StringDurationEncoder,
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
+}
+
+// sinkEncoder returns an encoder for syslog like sinks. Those sinks
+// have their own timestamp and severity, so we omit them.
+func sinkEncoder(format string) zapcore.Encoder {
+	ec := encoderConfig()
+	ec.TimeKey = ""
+	ec.LevelKey = ""
+	if format == "json" {
+		return zapcore.NewJSONEncoder(ec)
+	}
+	return zapcore.NewConsoleEncoder(ec)
+}
+
+// swapTarget holds the core of a swapCore. Every swap stores a new
+// swapTarget, so the pointer identifies the generation of the core.
+type swapTarget struct {
+	core zapcore.Core
+}
+
+// swapCore is a zapcore.Core that forwards everything to the core
+// currently stored in p. So the output of loggers can be changed
+// after they were created.
+type swapCore struct {
+	p      *atomic.Value // *swapTarget
+	fields []zapcore.Field
+
+	derived atomic.Value // *derivedCore, the core of p with fields.
+}
+
+type derivedCore struct {
+	t    *swapTarget
+	core zapcore.Core
+}
+
+// load returns the current core with s.fields. The derived core is
+// cached until the core is swapped.
+func (s *swapCore) load() zapcore.Core {
+	t := s.p.Load().(*swapTarget)
+	if len(s.fields) == 0 {
+		return t.core
+	}
+	if d, _ := s.derived.Load().(*derivedCore); d != nil && d.t == t {
+		return d.core
+	}
+	c := t.core.With(s.fields)
+	s.derived.Store(&derivedCore{t: t, core: c})
+	return c
+}
+
+func (s *swapCore) Enabled(l zapcore.Level) bool {
+	return s.p.Load().(*swapTarget).core.Enabled(l)
+}
+
+func (s *swapCore) With(fields []zapcore.Field) zapcore.Core {
+	f := make([]zapcore.Field, 0, len(s.fields)+len(fields))
+	f = append(f, s.fields...)
+	f = append(f, fields...)
+	return &swapCore{p: s.p, fields: f}
+}
+
+func (s *swapCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// The inner core adds itself to ce.
+	return s.load().Check(e, ce)
+}
+
+func (s *swapCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	return s.load().Write(e, fields)
+}
 
-	core := zapcore.NewCore(zapcore.NewConsoleEncoder(ec), zapcore.Lock(os.Stderr), logLvl)
-	return zap.New(core)
+func (s *swapCore) Sync() error {
+	return s.p.Load().(*swapTarget).core.Sync()
 }
@@ -0,0 +1,65 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"sync/atomic"
+	"testing"
+)
+
+// withCounter counts the calls of With.
+type withCounter struct {
+	zapcore.Core
+	n *int32
+}
+
+func (c withCounter) With(fields []zapcore.Field) zapcore.Core {
+	atomic.AddInt32(c.n, 1)
+	return c.Core.With(fields)
+}
+
+func Test_swapCore(t *testing.T) {
+	var n int32
+	core1, logs1 := observer.New(zap.InfoLevel)
+	core2, logs2 := observer.New(zap.InfoLevel)
+	p := new(atomic.Value)
+	p.Store(&swapTarget{core: withCounter{Core: core1, n: &n}})
+
+	l := zap.New(&swapCore{p: p}).With(zap.String("k", "v"))
+	for i := 0; i < 3; i++ {
+		l.Info("test")
+	}
+	if n != 1 {
+		t.Fatalf("the derived core should be cached, With was called %d times", n)
+	}
+
+	p.Store(&swapTarget{core: withCounter{Core: core2, n: &n}})
+	l.Info("test")
+	if n != 2 {
+		t.Fatalf("the derived core should be rebuilt after a swap, With was called %d times", n)
+	}
+	if logs1.Len() != 3 || logs2.Len() != 1 {
+		t.Fatalf("unexpected log counts %d, %d", logs1.Len(), logs2.Len())
+	}
+	if f := logs2.All()[0].ContextMap(); f["k"] != "v" {
+		t.Fatalf("fields are missing after a swap, got %v", f)
+	}
+}
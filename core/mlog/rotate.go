@@ -0,0 +1,222 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotateWriter is a zapcore.WriteSyncer that writes to a file and rotates
+// it by size and/or by time. Rotated files are named as
+// "<file>.<timestamp>", or "<file>.<timestamp>-<n>" if there were more than
+// one rotation within the same millisecond.
+type rotateWriter struct {
+	path       string
+	maxSize    int64         // <= 0 disables size based rotation.
+	interval   time.Duration // <= 0 disables time based rotation.
+	maxBackups int
+	maxAge     time.Duration
+	now        func() time.Time
+
+	m          sync.Mutex
+	f          *os.File
+	size       int64
+	nextRotate time.Time
+	backupTs   string // timestamp of the last backup.
+	backupSeq  int    // seq of the last backup within backupTs.
+}
+
+func newRotateWriter(path string, maxSize int64, interval time.Duration, maxBackups int, maxAge time.Duration) (*rotateWriter, error) {
+	w := &rotateWriter{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	if w.interval > 0 {
+		w.nextRotate = w.now().Truncate(w.interval).Add(w.interval)
+	}
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.needRotateLocked(int64(len(p))) {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) needRotateLocked(l int64) bool {
+	if w.maxSize > 0 && w.size > 0 && w.size+l > w.maxSize {
+		return true
+	}
+	if w.interval > 0 && !w.now().Before(w.nextRotate) {
+		return true
+	}
+	return false
+}
+
+// Rotate rotates the log file immediately.
+func (w *rotateWriter) Rotate() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.rotateLocked()
+}
+
+func (w *rotateWriter) rotateLocked() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	// The seq only grows within the same timestamp. So a name that was
+	// freed by removeOldBackupsLocked won't be reused by a newer backup.
+	ts := w.now().Format(backupTimeFormat)
+	if ts == w.backupTs {
+		w.backupSeq++
+	} else {
+		w.backupTs, w.backupSeq = ts, 0
+	}
+	var backup string
+	for ; ; w.backupSeq++ {
+		backup = w.path + "." + ts
+		if w.backupSeq > 0 {
+			backup = fmt.Sprintf("%s-%d", backup, w.backupSeq)
+		}
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			break
+		}
+	}
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.removeOldBackupsLocked()
+	return nil
+}
+
+// removeOldBackupsLocked removes backups that exceed maxBackups or maxAge.
+// Errors are ignored, there is no place to report them.
+func (w *rotateWriter) removeOldBackupsLocked() {
+	if w.maxBackups <= 0 && w.maxAge <= 0 {
+		return
+	}
+
+	dir := filepath.Dir(w.path)
+	prefix := filepath.Base(w.path) + "."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		t    time.Time
+		n    int
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, n, ok := parseBackupSuffix(strings.TrimPrefix(name, prefix))
+		if !ok {
+			continue // not a backup file
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, name), t: t, n: n})
+	}
+
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].t.Equal(backups[j].t) {
+			return backups[i].n > backups[j].n
+		}
+		return backups[i].t.After(backups[j].t)
+	})
+	for i, b := range backups {
+		if (w.maxBackups > 0 && i >= w.maxBackups) || (w.maxAge > 0 && time.Since(b.t) > w.maxAge) {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+// parseBackupSuffix parses "<timestamp>" or "<timestamp>-<n>".
+func parseBackupSuffix(s string) (t time.Time, n int, ok bool) {
+	if len(s) < len(backupTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	t, err := time.ParseInLocation(backupTimeFormat, s[:len(backupTimeFormat)], time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if seq := s[len(backupTimeFormat):]; len(seq) > 0 {
+		if !strings.HasPrefix(seq, "-") {
+			return time.Time{}, 0, false
+		}
+		n, err = strconv.Atoi(seq[1:])
+		if err != nil || n <= 0 {
+			return time.Time{}, 0, false
+		}
+	}
+	return t, n, true
+}
+
+func (w *rotateWriter) Sync() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.f.Sync()
+}
@@ -0,0 +1,75 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_rotateWriter(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "test.log")
+	w, err := newRotateWriter(p, 16, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.f.Close()
+	now := time.Now()
+	w.now = func() time.Time { return now }
+
+	// Every write rotates the file, all in the same millisecond.
+	line := func(i int) string { return fmt.Sprintf("line %04d\n", i) }
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte(line(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != line(4) {
+		t.Fatalf("unexpected active file content %q", b)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "test.log.") {
+			b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			backups = append(backups, string(b))
+		}
+	}
+	sort.Strings(backups)
+	if len(backups) != 2 || backups[0] != line(2) || backups[1] != line(3) {
+		t.Fatalf("want the 2 newest backups, got %q", backups)
+	}
+}
@@ -0,0 +1,91 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"bytes"
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"strings"
+)
+
+// leveledSink is an output that keeps the severity of each entry,
+// e.g. syslog or journald.
+type leveledSink interface {
+	write(lvl zapcore.Level, msg []byte) error
+	sync() error
+}
+
+func newLeveledSink(target string) (leveledSink, error) {
+	if target == "journald" {
+		return newJournaldSink()
+	}
+	network, addr := "", ""
+	if target != "local" {
+		n, a, ok := strings.Cut(target, "://")
+		if !ok {
+			return nil, fmt.Errorf("invalid syslog target [%s]", target)
+		}
+		switch n {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			return nil, fmt.Errorf("unsupported syslog network [%s]", n)
+		}
+		network, addr = n, a
+	}
+	return newSyslogSink(network, addr)
+}
+
+// leveledCore is a zapcore.Core that writes encoded entries to a leveledSink.
+type leveledCore struct {
+	zapcore.LevelEnabler
+	enc  zapcore.Encoder
+	sink leveledSink
+}
+
+func newLeveledCore(enc zapcore.Encoder, sink leveledSink, enab zapcore.LevelEnabler) zapcore.Core {
+	return &leveledCore{LevelEnabler: enab, enc: enc, sink: sink}
+}
+
+func (c *leveledCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := &leveledCore{LevelEnabler: c.LevelEnabler, enc: c.enc.Clone(), sink: c.sink}
+	for _, f := range fields {
+		f.AddTo(clone.enc)
+	}
+	return clone
+}
+
+func (c *leveledCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c *leveledCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(e, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	return c.sink.write(e.Level, bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+func (c *leveledCore) Sync() error {
+	return c.sink.sync()
+}
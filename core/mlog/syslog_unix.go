@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mlog
+
+import (
+	"go.uber.org/zap/zapcore"
+	"log/syslog"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(network, addr string) (leveledSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "simple-tls")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(lvl zapcore.Level, msg []byte) error {
+	m := string(msg)
+	switch lvl {
+	case zapcore.DebugLevel:
+		return s.w.Debug(m)
+	case zapcore.InfoLevel:
+		return s.w.Info(m)
+	case zapcore.WarnLevel:
+		return s.w.Warning(m)
+	case zapcore.ErrorLevel:
+		return s.w.Err(m)
+	case zapcore.DPanicLevel, zapcore.PanicLevel:
+		return s.w.Crit(m)
+	default:
+		return s.w.Emerg(m)
+	}
+}
+
+func (s *syslogSink) sync() error {
+	return nil
+}
@@ -0,0 +1,223 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout     = time.Second * 5
+	probeLossPenalty = time.Second // score penalty of 100% loss.
+	rttAlpha         = 0.25
+	lossAlpha        = 0.2
+	// A new server will be selected only if its score is lower than
+	// the current one's by this ratio. So the choice doesn't flap.
+	switchThreshold = 0.8
+
+	// probeALPN is offered by the tls probes of raw tls servers. Servers
+	// close such conns after the handshake without opening a tunnel.
+	probeALPN = "simple-tls-probe"
+	// healthCheckMethod is called by the grpc probes.
+	healthCheckMethod = "/grpc.health.v1.Health/Check"
+)
+
+// UpstreamStatus is the probe status of a server.
+type UpstreamStatus struct {
+	Addr     string        `json:"addr"`
+	Healthy  bool          `json:"healthy"`  // false if the server is in the dial backoff.
+	Selected bool          `json:"selected"` // whether it is the best server by probes.
+	Probed   bool          `json:"probed"`
+	RTT      time.Duration `json:"rtt"`  // smoothed probe RTT.
+	Loss     float64       `json:"loss"` // smoothed probe loss rate.
+	LastErr  string        `json:"last_err,omitempty"`
+}
+
+// Status returns the status of the servers. Probe fields are valid only
+// if ProbeInterval > 0.
+func (c *Client) Status() []UpstreamStatus {
+	c.selectM.Lock()
+	selected := c.selected
+	c.selectM.Unlock()
+
+	now := time.Now()
+	s := make([]UpstreamStatus, 0, len(c.upstreams))
+	for _, u := range c.upstreams {
+		u.m.Lock()
+		us := UpstreamStatus{
+			Addr:     u.Addr,
+			Healthy:  !now.Before(u.retryAt),
+			Selected: u == selected,
+			Probed:   u.probed,
+			RTT:      u.srtt,
+			Loss:     u.loss,
+		}
+		if u.probeErr != nil {
+			us.LastErr = u.probeErr.Error()
+		}
+		u.m.Unlock()
+		s = append(s, us)
+	}
+	return s
+}
+
+// probeLoop probes all servers every ProbeInterval until stop is closed.
+func (c *Client) probeLoop(stop chan struct{}) {
+	ticker := time.NewTicker(c.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		c.probeAll()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *Client) probeAll() {
+	timeout := probeTimeout
+	if c.ProbeInterval < timeout {
+		timeout = c.ProbeInterval
+	}
+	wg := new(sync.WaitGroup)
+	for _, u := range c.upstreams {
+		u := u
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			err := u.probe(ctx)
+			rtt := time.Since(start)
+			u.updateProbe(rtt, err)
+			if err != nil {
+				c.logger.l.Debug("probe failed", zap.String("server", u.Addr), zap.Error(err))
+			} else {
+				c.logger.l.Debug("probe", zap.String("server", u.Addr), zap.Duration("rtt", rtt))
+			}
+		}()
+	}
+	wg.Wait()
+	c.selectUpstream()
+}
+
+// updateProbe updates the estimates of u with a probe result.
+func (u *upstream) updateProbe(rtt time.Duration, err error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.probeErr = err
+	sample := 0.0
+	if err != nil {
+		sample = 1
+	}
+	if !u.probed {
+		u.probed = true
+		u.loss = sample
+		if err == nil {
+			u.srtt = rtt
+		}
+		return
+	}
+	u.loss += lossAlpha * (sample - u.loss)
+	if err == nil {
+		if u.srtt == 0 {
+			u.srtt = rtt
+		} else {
+			u.srtt += time.Duration(rttAlpha * float64(rtt-u.srtt))
+		}
+	}
+}
+
+// score returns the score of u. Lower is better. ok is false if u was not
+// successfully probed yet or it is unhealthy.
+func (u *upstream) score(now time.Time) (score time.Duration, ok bool) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if !u.probed || u.srtt == 0 || now.Before(u.retryAt) {
+		return 0, false
+	}
+	return u.srtt + time.Duration(u.loss*float64(probeLossPenalty)), true
+}
+
+// selectUpstream selects the server with the lowest score. The current
+// selection is kept unless the new one is significantly better.
+func (c *Client) selectUpstream() {
+	now := time.Now()
+	var best *upstream
+	var bestScore time.Duration
+	for _, u := range c.upstreams {
+		if s, ok := u.score(now); ok && (best == nil || s < bestScore) {
+			best, bestScore = u, s
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	c.selectM.Lock()
+	defer c.selectM.Unlock()
+	cur := c.selected
+	if cur == best {
+		return
+	}
+	if cur != nil {
+		if curScore, ok := cur.score(now); ok && float64(bestScore) > float64(curScore)*switchThreshold {
+			return
+		}
+	}
+	c.selected = best
+	c.logger.l.Info("server selected", zap.String("server", best.Addr), zap.Duration("score", bestScore))
+}
+
+// grpcHealthProbe returns a probe that measures the RTT of a grpc health
+// check. The server may not have the health service (see Server.GRPCHealth),
+// Unimplemented is also a valid round trip.
+func grpcHealthProbe(u *upstream, dialOpts []grpc.DialOption) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		u.m.Lock()
+		if u.closed {
+			u.m.Unlock()
+			return ErrClientClosed
+		}
+		if u.probeCc == nil {
+			cc, err := grpc.Dial(u.Addr, dialOpts...)
+			if err != nil {
+				u.m.Unlock()
+				return err
+			}
+			u.probeCc = cc
+		}
+		cc := u.probeCc
+		u.m.Unlock()
+
+		_, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		return err
+	}
+}
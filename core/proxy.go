@@ -0,0 +1,222 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newProxyDialer returns a dial func that connects to addr through the
+// proxy. proxyURL can be "http://[user:pass@]host:port" (HTTP CONNECT)
+// or "socks5://[user:pass@]host:port". d is used to dial the proxy.
+func newProxyDialer(proxyURL string, d *net.Dialer) (dialContextFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if len(u.Port()) == 0 {
+		return nil, fmt.Errorf("proxy url [%s] has no port", proxyURL)
+	}
+
+	var handshake func(c net.Conn, addr string, user *url.Userinfo) (net.Conn, error)
+	switch u.Scheme {
+	case "http":
+		handshake = httpConnect
+	case "socks5":
+		handshake = socks5Connect
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme [%s]", u.Scheme)
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial proxy: %w", err)
+		}
+
+		// Apply ctx to the handshake.
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		handshakeDone := make(chan struct{})
+		watcherDone := make(chan struct{})
+		go func() {
+			defer close(watcherDone)
+			select {
+			case <-ctx.Done():
+				c.SetDeadline(time.Unix(1, 0))
+			case <-handshakeDone:
+			}
+		}()
+		pc, err := handshake(c, addr, u.User)
+		close(handshakeDone)
+		<-watcherDone
+		if err != nil {
+			c.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("proxy handshake failed: %w", err)
+		}
+		c.SetDeadline(time.Time{})
+		return pc, nil
+	}, nil
+}
+
+// httpConnect sends a HTTP CONNECT request to c.
+func httpConnect(c net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy responded %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The proxy sent data before we did, e.g. the server's first bytes.
+		b, _ := br.Peek(br.Buffered())
+		return &prefixConn{Conn: c, prefix: append([]byte(nil), b...)}, nil
+	}
+	return c, nil
+}
+
+var errSocks5Auth = errors.New("socks5 authentication failed")
+
+// socks5Connect does a socks5 CONNECT (RFC 1928) with optional
+// username/password authentication (RFC 1929).
+func socks5Connect(c net.Conn, addr string, user *url.Userinfo) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port [%s]", portStr)
+	}
+
+	method := byte(0x00) // no auth
+	if user != nil {
+		method = 0x02 // username/password
+	}
+	if _, err := c.Write([]byte{0x05, 1, method}); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	if b[0] != 0x05 || b[1] != method {
+		return nil, fmt.Errorf("socks5 method %d not accepted", method)
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return nil, errors.New("socks5 username or password too long")
+		}
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		if b[1] != 0x00 {
+			return nil, errSocks5Auth
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00} // CONNECT
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long [%s]", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if resp[1] != 0x00 {
+		return nil, fmt.Errorf("socks5 connect failed with code %d", resp[1])
+	}
+	var addrLen int
+	switch resp[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return nil, err
+		}
+		addrLen = int(l[0])
+	default:
+		return nil, fmt.Errorf("invalid socks5 address type %d", resp[3])
+	}
+	if _, err := io.ReadFull(c, make([]byte, addrLen+2)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
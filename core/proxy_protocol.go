@@ -0,0 +1,169 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"github.com/IrineSistiana/simple-tls/core/proxyproto"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultProxyHeaderTimeout = time.Second * 5
+
+// proxyProtoListener reads PROXY protocol headers from conns whose
+// remote addresses are in trusted. The addresses in the headers become
+// the addresses of the conns. Conns from other addresses are returned
+// as they are.
+// Headers are read in separate goroutines, so slow conns won't block
+// the Accept loop.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+	logger  connLogger
+
+	conns      chan net.Conn
+	acceptErr  error // valid after acceptDone was closed.
+	acceptDone chan struct{}
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func newProxyProtoListener(l net.Listener, trusted []*net.IPNet, timeout time.Duration, logger connLogger) net.Listener {
+	if len(trusted) == 0 {
+		return l
+	}
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	pl := &proxyProtoListener{
+		Listener:   l,
+		trusted:    trusted,
+		timeout:    timeout,
+		logger:     logger,
+		conns:      make(chan net.Conn),
+		acceptDone: make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (l *proxyProtoListener) acceptLoop() {
+	defer close(l.acceptDone)
+	var tempDelay time.Duration // how long to sleep on temporary errors, e.g. EMFILE.
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				l.logger.l.Warn("accept error, retrying", zap.Duration("delay", tempDelay), zap.Error(err))
+				select {
+				case <-time.After(tempDelay):
+					continue
+				case <-l.closed:
+				}
+			}
+			l.acceptErr = err
+			return
+		}
+		tempDelay = 0
+		go func() {
+			c, err := l.readHeader(c)
+			if err != nil {
+				l.logger.forConn(c).logConnErr("failed to read proxy protocol header", err)
+				_ = c.Close()
+				return
+			}
+			select {
+			case l.conns <- c:
+			case <-l.closed:
+				_ = c.Close()
+			case <-l.acceptDone:
+				_ = c.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyProtoListener) readHeader(c net.Conn) (net.Conn, error) {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !containsIP(l.trusted, addr.IP) {
+		return c, nil
+	}
+
+	c.SetReadDeadline(time.Now().Add(l.timeout))
+	r := bufio.NewReader(c)
+	h, err := proxyproto.Read(r)
+	if err != nil {
+		return c, err
+	}
+	c.SetReadDeadline(time.Time{})
+
+	buffered, _ := r.Peek(r.Buffered())
+	pc := &proxiedConn{Conn: &prefixConn{Conn: c, prefix: buffered}, src: c.RemoteAddr(), dst: c.LocalAddr()}
+	if !h.Local && h.Src != nil {
+		pc.src, pc.dst = h.Src, h.Dst
+		l.logger.l.Debug("proxy protocol header received", zap.Stringer("proxy", c.RemoteAddr()), zap.Stringer("remote", h.Src))
+	}
+	return pc, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.acceptDone:
+		return nil, l.acceptErr
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// proxiedConn is a net.Conn with the addresses from a PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	src, dst net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
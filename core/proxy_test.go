@@ -0,0 +1,168 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_ClientProxy(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	cert := newTestCert(t)
+
+	proxies := map[string]func(c net.Conn) (string, error){
+		"http":   testHTTPConnect,
+		"socks5": testSocks5Connect,
+	}
+	for scheme, handshake := range proxies {
+		for _, grpc := range [...]bool{false, true} {
+			t.Run(fmt.Sprintf("%s_grpc_%v", scheme, grpc), func(t *testing.T) {
+				server := &Server{
+					DstAddr:     echoListener.Addr().String(),
+					GRPC:        grpc,
+					IdleTimeout: time.Minute,
+					testCert:    &cert,
+				}
+				serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go server.Serve(context.Background(), serverListener)
+				defer server.Close()
+
+				proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer proxyListener.Close()
+				go serveTestProxy(proxyListener, handshake)
+
+				client := &Client{
+					DstAddr:            serverListener.Addr().String(),
+					GRPC:               grpc,
+					InsecureSkipVerify: true,
+					Proxy:              scheme + "://user:pass@" + proxyListener.Addr().String(),
+				}
+				defer client.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+				defer cancel()
+				conn, err := client.Dial(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(time.Second * 5))
+				b := []byte("hello")
+				if _, err := conn.Write(b); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, len(b))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, buf) {
+					t.Fatal("corrupted data")
+				}
+			})
+		}
+	}
+}
+
+// serveTestProxy is a proxy server. handshake returns the target address.
+func serveTestProxy(l net.Listener, handshake func(c net.Conn) (string, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			addr, err := handshake(c)
+			if err != nil {
+				return
+			}
+			dst, err := net.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer dst.Close()
+			go io.Copy(dst, c)
+			io.Copy(c, dst)
+		}()
+	}
+}
+
+func testHTTPConnect(c net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", fmt.Errorf("invalid method %s", req.Method)
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return "", fmt.Errorf("invalid auth")
+	}
+	_, err = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host, err
+}
+
+func testSocks5Connect(c net.Conn) (string, error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(c, b); err != nil || b[2] != 0x02 {
+		return "", fmt.Errorf("invalid greeting")
+	}
+	c.Write([]byte{0x05, 0x02})
+	// auth: VER ULEN UNAME PLEN PASSWD
+	b = make([]byte, 2)
+	io.ReadFull(c, b)
+	user := make([]byte, b[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, b[:1])
+	pass := make([]byte, b[0])
+	io.ReadFull(c, pass)
+	if string(user) != "user" || string(pass) != "pass" {
+		c.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("invalid auth")
+	}
+	c.Write([]byte{0x01, 0x00})
+
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || b[3] != 0x01 {
+		return "", fmt.Errorf("invalid request")
+	}
+	addr := make([]byte, 6)
+	if _, err := io.ReadFull(c, addr); err != nil {
+		return "", err
+	}
+	c.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	port := int(addr[4])<<8 | int(addr[5])
+	return net.JoinHostPort(net.IP(addr[:4]).String(), strconv.Itoa(port)), nil
+}
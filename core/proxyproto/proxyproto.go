@@ -0,0 +1,194 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package proxyproto implements the PROXY protocol v1 and v2 headers,
+// see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// v2 TLV types.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02 // the host name (SNI) of the client.
+	TypeSSL       byte = 0x20
+
+	SubtypeSSLVersion byte = 0x21
+	SubtypeSSLCN      byte = 0x22
+	SubtypeSSLCipher  byte = 0x23
+)
+
+// Client flags of the TypeSSL TLV.
+const (
+	ClientSSL      byte = 0x01
+	ClientCertConn byte = 0x02
+	ClientCertSess byte = 0x04
+)
+
+var v2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidVersion = errors.New("invalid proxy protocol version")
+
+// TLV is a v2 type-length-value extension.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY protocol header.
+type Header struct {
+	Version byte // 1 or 2.
+
+	// Local means the conn was not proxied (e.g. a health check).
+	// Src and Dst are ignored.
+	Local bool
+
+	// Src and Dst are the addresses of the proxied conn. Only
+	// *net.TCPAddr is supported. Otherwise, the addresses are unknown.
+	// If only Dst is unknown, an unspecified address of the same
+	// family as Src will be sent.
+	Src, Dst net.Addr
+
+	TLVs []TLV // v2 only.
+}
+
+// SSLTLV returns a TypeSSL TLV. The client certificate is verified
+// if verified is true.
+func SSLTLV(client byte, verified bool, subs ...TLV) TLV {
+	v := make([]byte, 5)
+	v[0] = client
+	if !verified {
+		binary.BigEndian.PutUint32(v[1:], 1)
+	}
+	return TLV{Type: TypeSSL, Value: appendTLVs(v, subs)}
+}
+
+// Format returns the wire format of h.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2()
+	default:
+		return nil, ErrInvalidVersion
+	}
+}
+
+// WriteTo writes h to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// addrs returns the src and dst addresses of h. ok is false if they
+// are unknown. dst will be an unspecified address if it is unknown.
+// If only one of them is an ipv4 address, it will be mapped to ipv6.
+func (h *Header) addrs() (src, dst *net.TCPAddr, v4 bool, ok bool) {
+	if h.Local {
+		return nil, nil, false, false
+	}
+	src, _ = h.Src.(*net.TCPAddr)
+	if src == nil || src.IP == nil {
+		return nil, nil, false, false
+	}
+	v4 = src.IP.To4() != nil
+	dst, _ = h.Dst.(*net.TCPAddr)
+	if dst == nil || dst.IP == nil {
+		dst = &net.TCPAddr{IP: net.IPv4zero}
+		if !v4 {
+			dst.IP = net.IPv6unspecified
+		}
+	}
+	v4 = v4 && dst.IP.To4() != nil
+	return src, dst, v4, true
+}
+
+func (h *Header) formatV1() []byte {
+	src, dst, v4, ok := h.addrs()
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto, srcIP, dstIP := "TCP6", src.IP.To16().String(), dst.IP.To16().String()
+	if v4 {
+		proto, srcIP, dstIP = "TCP4", src.IP.To4().String(), dst.IP.To4().String()
+	} else {
+		// A v4-mapped ipv6 address is printed as a ipv4 address by
+		// net.IP.String().
+		srcIP, dstIP = formatIPv6(src.IP), formatIPv6(dst.IP)
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port))
+}
+
+func formatIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	b := make([]byte, 16, 16+36)
+	copy(b, v2Sig)
+	src, dst, v4, ok := h.addrs()
+	switch {
+	case h.Local:
+		b[12] = 0x20
+	case !ok:
+		b[12] = 0x21
+	case v4:
+		b[12], b[13] = 0x21, 0x11
+		b = append(b, src.IP.To4()...)
+		b = append(b, dst.IP.To4()...)
+		b = appendPorts(b, src.Port, dst.Port)
+	default:
+		b[12], b[13] = 0x21, 0x21
+		b = append(b, src.IP.To16()...)
+		b = append(b, dst.IP.To16()...)
+		b = appendPorts(b, src.Port, dst.Port)
+	}
+	b = appendTLVs(b, h.TLVs)
+	l := len(b) - 16
+	if l > 0xffff {
+		return nil, fmt.Errorf("header is too large, length %d", l)
+	}
+	binary.BigEndian.PutUint16(b[14:], uint16(l))
+	return b, nil
+}
+
+func appendPorts(b []byte, src, dst int) []byte {
+	return append(b, byte(src>>8), byte(src), byte(dst>>8), byte(dst))
+}
+
+func appendTLVs(b []byte, tlvs []TLV) []byte {
+	for _, tlv := range tlvs {
+		l := len(tlv.Value)
+		b = append(b, tlv.Type, byte(l>>8), byte(l))
+		b = append(b, tlv.Value...)
+	}
+	return b
+}
@@ -0,0 +1,159 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_formatV1(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+		want string
+	}{
+		{"tcp4", Header{Src: tcpAddr("1.2.3.4:1000"), Dst: tcpAddr("5.6.7.8:443")}, "PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n"},
+		{"tcp6", Header{Src: tcpAddr("[2001:db8::1]:1000"), Dst: tcpAddr("[2001:db8::2]:443")}, "PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\n"},
+		{"mixed", Header{Src: tcpAddr("1.2.3.4:1000"), Dst: tcpAddr("[2001:db8::2]:443")}, "PROXY TCP6 ::ffff:1.2.3.4 2001:db8::2 1000 443\r\n"},
+		{"no dst", Header{Src: tcpAddr("1.2.3.4:1000")}, "PROXY TCP4 1.2.3.4 0.0.0.0 1000 0\r\n"},
+		{"unknown", Header{Src: &net.UnixAddr{Name: "/tmp/a", Net: "unix"}}, "PROXY UNKNOWN\r\n"},
+		{"local", Header{Local: true, Src: tcpAddr("1.2.3.4:1000")}, "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Version = 1
+			b, err := tt.h.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Fatalf("want %q, got %q", tt.want, b)
+			}
+		})
+	}
+}
+
+func Test_formatV2(t *testing.T) {
+	h := Header{
+		Version: 2,
+		Src:     tcpAddr("1.2.3.4:1000"),
+		Dst:     tcpAddr("5.6.7.8:443"),
+		TLVs:    []TLV{{Type: TypeAuthority, Value: []byte("a.com")}},
+	}
+	b, err := h.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0, 20,
+		1, 2, 3, 4, 5, 6, 7, 8, 0x03, 0xe8, 0x01, 0xbb,
+		TypeAuthority, 0, 5, 'a', '.', 'c', 'o', 'm',
+	)
+	if !bytes.Equal(b, want) {
+		t.Fatalf("want %x, got %x", want, b)
+	}
+
+	h = Header{Version: 2, Local: true}
+	b, err = h.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0, 0, 0); !bytes.Equal(b, want) {
+		t.Fatalf("want %x, got %x", want, b)
+	}
+
+	h = Header{Version: 3}
+	if _, err := h.Format(); err != ErrInvalidVersion {
+		t.Fatalf("want ErrInvalidVersion, got %v", err)
+	}
+}
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func Test_Read(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+	}{
+		{"v1 tcp4", Header{Version: 1, Src: tcpAddr("1.2.3.4:1000"), Dst: tcpAddr("5.6.7.8:443")}},
+		{"v1 tcp6", Header{Version: 1, Src: tcpAddr("[2001:db8::1]:1000"), Dst: tcpAddr("[2001:db8::2]:443")}},
+		{"v1 unknown", Header{Version: 1}},
+		{"v2 tcp4", Header{Version: 2, Src: tcpAddr("1.2.3.4:1000"), Dst: tcpAddr("5.6.7.8:443")}},
+		{"v2 tcp6", Header{Version: 2, Src: tcpAddr("[2001:db8::1]:1000"), Dst: tcpAddr("[2001:db8::2]:443")}},
+		{"v2 local", Header{Version: 2, Local: true}},
+		{"v2 tlv", Header{
+			Version: 2,
+			Src:     tcpAddr("1.2.3.4:1000"),
+			Dst:     tcpAddr("5.6.7.8:443"),
+			TLVs:    []TLV{{Type: TypeALPN, Value: []byte("h2")}, SSLTLV(ClientSSL, true, TLV{Type: SubtypeSSLCN, Value: []byte("a")})},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.h.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(bytes.NewReader(append(b, "payload"...)))
+			h, err := Read(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(tt.h) != fmt.Sprint(*h) || !reflect.DeepEqual(tt.h.TLVs, h.TLVs) {
+				t.Fatalf("want %+v, got %+v", tt.h, *h)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("payload broken, got %q", rest)
+			}
+		})
+	}
+
+	for _, s := range []string{
+		"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00\x00",
+		"GET / HTTP/1.1\r\n\r\n",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(s))); err != ErrNoHeader {
+			t.Fatalf("want ErrNoHeader, got %v", err)
+		}
+	}
+	for _, s := range []string{
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1000\r\n",
+		"PROXY TCP4 ::1 5.6.7.8 1000 443\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1000 70000\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120),
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00\x00\x00",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(s))); err == nil {
+			t.Fatalf("want an error for %q", s)
+		}
+	}
+}
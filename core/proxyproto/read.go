@@ -0,0 +1,171 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrNoHeader = errors.New("no proxy protocol header")
+
+const v1MaxLen = 107
+
+// Read reads a v1 or v2 header from r. It returns ErrNoHeader if r
+// does not start with a header. Unsupported addresses (e.g. unix
+// sockets, udp) are returned as nil.
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(v2Sig))
+	if err != nil {
+		if err == io.EOF && len(b) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(b, v2Sig):
+		return readV2(r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return readV1(r)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLen {
+			return nil, errors.New("v1 header is too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	src, err := parseV1Addr(f[2], f[4], f[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(f[3], f[5], f[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	h.Src, h.Dst = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ipStr, portStr string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || v4 && ip.To4() == nil {
+		return nil, fmt.Errorf("invalid ip [%s]", ipStr)
+	}
+	if v4 {
+		ip = ip.To4()
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port [%s]", portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid v2 version %d", hdr[12]>>4)
+	}
+	h := &Header{Version: 2}
+	switch hdr[12] & 0x0f {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, fmt.Errorf("invalid v2 command %d", hdr[12]&0x0f)
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	var addrLen int
+	switch hdr[13] >> 4 {
+	case 0: // unspec
+	case 1:
+		addrLen = 12
+	case 2:
+		addrLen = 36
+	case 3:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("invalid v2 address family %d", hdr[13]>>4)
+	}
+	if len(b) < addrLen {
+		return nil, fmt.Errorf("v2 address is too short, want %d, got %d", addrLen, len(b))
+	}
+	if hdr[13] == 0x11 || hdr[13] == 0x21 { // tcp over ipv4 and ipv6
+		ipLen := (addrLen - 4) / 2
+		ports := b[ipLen*2:]
+		h.Src = &net.TCPAddr{IP: net.IP(b[:ipLen]), Port: int(binary.BigEndian.Uint16(ports))}
+		h.Dst = &net.TCPAddr{IP: net.IP(b[ipLen : ipLen*2]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	}
+
+	tlvs, err := parseTLVs(b[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.TLVs = tlvs
+	return h, nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("invalid tlv")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+l {
+			return nil, errors.New("invalid tlv length")
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
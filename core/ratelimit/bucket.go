@@ -0,0 +1,115 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. It is safe for concurrent use.
+type Bucket struct {
+	m      sync.Mutex
+	rate   float64 // tokens per second. <= 0 means unlimited.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full Bucket that refills rate tokens per second,
+// and holds at most burst tokens. If burst <= 0, burst is rate.
+// If rate <= 0, the bucket is unlimited.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := new(Bucket)
+	b.SetLimit(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetLimit changes the rate and burst of b. Tokens in b are kept.
+func (b *Bucket) SetLimit(rate float64, burst int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.advanceLocked(now)
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Limit returns the rate and burst of b.
+func (b *Bucket) Limit() (rate float64, burst int) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.rate, int(b.burst)
+}
+
+// Allow is AllowN(1).
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens from b if b has enough tokens.
+func (b *Bucket) AllowN(n int) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.advanceLocked(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// reserveN takes n tokens from b even if b does not have enough tokens.
+// It returns the time to wait until the debt is paid.
+func (b *Bucket) reserveN(now time.Time, n int) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.advanceLocked(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// advanceLocked refills tokens.
+func (b *Bucket) advanceLocked(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
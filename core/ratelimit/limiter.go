@@ -0,0 +1,85 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter is a node of hierarchical token buckets. Tokens taken from a
+// Limiter are also taken from all its ancestors, so children of the same
+// parent share the parent's rate.
+// Waiters queue behind earlier reservations. As long as children take
+// tokens in small chunks, the rate of the parent is shared fairly by its
+// busy children.
+// It is safe for concurrent use.
+type Limiter struct {
+	b      *Bucket
+	parent *Limiter
+	total  int64 // atomic, tokens that were taken.
+}
+
+// NewLimiter returns a Limiter under parent. parent can be nil.
+// rate and burst are the same as NewBucket.
+func NewLimiter(parent *Limiter, rate float64, burst int) *Limiter {
+	return &Limiter{b: NewBucket(rate, burst), parent: parent}
+}
+
+// SetLimit changes the rate and burst of l. It affects tokens that are
+// taken after the call.
+func (l *Limiter) SetLimit(rate float64, burst int) {
+	l.b.SetLimit(rate, burst)
+}
+
+// Limit returns the rate and burst of l.
+func (l *Limiter) Limit() (rate float64, burst int) {
+	return l.b.Limit()
+}
+
+// Total returns the number of tokens that were taken from l, including
+// the tokens taken by its children.
+func (l *Limiter) Total() int64 {
+	return atomic.LoadInt64(&l.total)
+}
+
+// WaitN takes n tokens from l and all its ancestors and blocks until
+// they are available or ctx is done. n can be larger than the burst.
+// Tokens are not returned if ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	now := time.Now()
+	var d time.Duration
+	for p := l; p != nil; p = p.parent {
+		atomic.AddInt64(&p.total, int64(n))
+		if w := p.b.reserveN(now, n); w > d {
+			d = w
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter_WaitN(t *testing.T) {
+	parent := NewLimiter(nil, 1000, 100)
+	a := NewLimiter(parent, 0, 0) // unlimited, limited by parent.
+	b := NewLimiter(parent, 0, 0)
+
+	start := time.Now()
+	wg := new(sync.WaitGroup)
+	for _, l := range [...]*Limiter{a, b} {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if err := l.WaitN(context.Background(), 10); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 200 tokens, 100 from the burst, the rest takes 100ms.
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+	assert.Equal(t, int64(100), a.Total())
+	assert.Equal(t, int64(100), b.Total())
+	assert.Equal(t, int64(200), parent.Total())
+}
+
+func TestLimiter_Cancel(t *testing.T) {
+	l := NewLimiter(nil, 10, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	// 100 tokens need 9s.
+	assert.Equal(t, context.DeadlineExceeded, l.WaitN(ctx, 100))
+}
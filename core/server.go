@@ -18,21 +18,31 @@
 package core
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/simple-tls/core/grpc_tunnel"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
-	"log"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
+	// BindAddr and DstAddr can also be unix sockets, "unix:/path" or
+	// "unix:@name" (abstract, linux only).
 	BindAddr              string
 	DstAddr               string
 	GRPC                  bool
@@ -41,25 +51,194 @@ type Server struct {
 	IdleTimeout           time.Duration
 	OutboundBuf           int
 	InboundBuf            int
+	// GRPCHealth registers the grpc health service in grpc mode. It is
+	// not authenticated by GRPCServiceName. Clients' latency probes work
+	// without it, see Client.ProbeInterval.
+	GRPCHealth bool
 
-	testListener         net.Listener
-	testCert             *tls.Certificate
-	testTransportHandler TransportHandler
+	// Handler handles all incoming tunnels. If Handler is nil, tunnels
+	// will be forwarded to DstAddr by DstTransportHandler.
+	// e.g. Use a TransportListener to serve tunnels in process.
+	Handler TransportHandler
+
+	// Middlewares wrap the handler of every route. The first one is the
+	// outermost one.
+	Middlewares []Middleware
+	// RouteMiddlewares wrap the handler of the route with the given name,
+	// inside Middlewares. In grpc mode, the route name is the grpc service
+	// name (path). In raw tls mode, the only route is "".
+	RouteMiddlewares map[string][]Middleware
+
+	// BackendOpts is used if a dst is a backend pool, e.g. "a:80|b:80".
+	// See NewBackendPool.
+	BackendOpts BackendPoolOpts
+	// SendProxy is the version of the PROXY protocol header that will be
+	// sent to the dst, see DstTransportHandler.ProxyProtocol. It is not
+	// used if Handler is set.
+	SendProxy int
+
+	// Limits limits the connections of the server.
+	Limits ConnLimits
+	// IPFilter, if not nil, closes connections from denied source IPs
+	// right after they were accepted.
+	IPFilter *IPFilter
+	// BanList, if not nil, bans source IPs that failed the tls handshake
+	// or requested unknown grpc paths too many times. Connections from
+	// banned IPs are closed right after they were accepted.
+	BanList *BanList
+	// AcceptProxy is a list of trusted CIDRs or IPs. Conns from them must
+	// start with a PROXY protocol v1 or v2 header (e.g. from HAProxy).
+	// The addresses in the header will be used as the addresses of the
+	// conns, e.g. in logs, limits, filters and SendProxy headers.
+	AcceptProxy []string
+	// AcceptProxyTimeout is the timeout for reading the PROXY protocol
+	// header. Default is 5s.
+	AcceptProxyTimeout time.Duration
+	// UnixSocket is used if BindAddr is a unix socket.
+	UnixSocket UnixSocketOpts
+	// SocketOpts is applied to the listener and the sockets to the dst,
+	// see TcpConfig.
+	SocketOpts *TcpConfig
+	// Listeners is the number of listeners that ActiveAndServe opens on
+	// BindAddr with SO_REUSEPORT, each has its own accept loop. Default
+	// is 1. Linux only.
+	Listeners int
+	// ActivatedListeners, if not empty, are served by ActiveAndServe
+	// instead of listening on BindAddr, e.g. the listeners from systemd
+	// socket activation. Only UnixSocket.AllowUIDs is applied to them,
+	// Listeners and the other UnixSocket opts are not used.
+	ActivatedListeners []net.Listener
+
+	// Logger is the logger of the server. If nil, the global logger from
+	// package mlog will be used.
+	Logger *zap.Logger
+	// Name is the name of the server. If not empty, it will be used to
+	// name the Logger. So logs from different instances can be told apart.
+	Name string
+
+	testCert *tls.Certificate
+
+	initOnce   sync.Once
+	initErr    error
+	tlsConfig  *tls.Config
+	rawHandler TransportHandler
+	grpcServer *grpc.Server // nil if not in grpc mode.
+	logger     connLogger
+	lnLimiter  *connLimiter // limits accepted conns, can be nil.
+	pools      []*BackendPool
+	proxyNets  []*net.IPNet // trusted nets of AcceptProxy.
+
+	fastOpenConns uint64 // atomic
+
+	lc lifecycle
 }
 
 var errMissingCertOrKey = errors.New("one of cert or key argument is missing")
 
+// ErrServerClosed is returned by Server.Serve after a call to
+// Server.Shutdown or Server.Close.
+var ErrServerClosed = errors.New("server closed")
+
+// ActiveAndServe listens on s.BindAddr and serves it, see Listeners.
 func (s *Server) ActiveAndServe() error {
-	var l net.Listener
-	if s.testListener != nil {
-		l = s.testListener
+	s.initOnce.Do(func() {
+		s.initErr = s.init()
+	})
+	if s.initErr != nil {
+		return s.initErr
+	}
+	var ls []net.Listener
+	var err error
+	if len(s.ActivatedListeners) > 0 {
+		ls, err = activatedListeners(s.ActivatedListeners, s.UnixSocket, s.logger)
 	} else {
-		var err error
-		l, err = net.Listen("tcp", s.BindAddr)
-		if err != nil {
-			return err
+		ls, err = listenN(s.BindAddr, s.Listeners, s.UnixSocket, s.SocketOpts, s.logger)
+	}
+	if err != nil {
+		return err
+	}
+	return serveListeners(ls, func(l net.Listener) error {
+		return s.Serve(context.Background(), l)
+	})
+}
+
+// Serve accepts connections on l until ctx is done or the server is
+// closed. If ctx is done, the server will be closed. Serve can be called
+// multiple times with different listeners. l will be closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	defer l.Close()
+
+	s.initOnce.Do(func() {
+		s.initErr = s.init()
+	})
+	if s.initErr != nil {
+		return s.initErr
+	}
+
+	if !s.lc.addListener(l) {
+		return ErrServerClosed
+	}
+	defer s.lc.removeListener(l)
+
+	serveDone := make(chan struct{})
+	defer close(serveDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+		case <-serveDone:
 		}
+	}()
+
+	var err error
+	ll := newFastOpenListener(l, s.SocketOpts, &s.fastOpenConns)
+	ll = newProxyProtoListener(ll, s.proxyNets, s.AcceptProxyTimeout, s.logger)
+	ll = newLimitListener(s.BanList.Listener(s.IPFilter.listener(ll, s.logger)), s.lnLimiter, "", s.logger)
+	if s.grpcServer != nil {
+		err = s.grpcServer.Serve(ll)
+	} else {
+		err = listenRawConn(tls.NewListener(ll, s.tlsConfig), s.rawHandler, &s.lc.tunnels, s.logger, s.BanList)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.lc.isClosed() {
+		return ErrServerClosed
 	}
+	return err
+}
+
+// FastOpenConns returns the number of accepted conns that used tcp
+// fast open, see TcpConfig.FastOpen.
+func (s *Server) FastOpenConns() uint64 {
+	return atomic.LoadUint64(&s.fastOpenConns)
+}
+
+// Ready returns a channel that is closed when the server starts
+// serving its first listener.
+func (s *Server) Ready() <-chan struct{} {
+	return s.lc.readyChan()
+}
+
+// Addr returns the address of the first listener that the server serves.
+// It returns nil if the server is not ready.
+func (s *Server) Addr() net.Addr {
+	return s.lc.listenAddr()
+}
+
+func (s *Server) init() error {
+	s.logger = newConnLogger(s.Logger, s.Name)
+	if s.SendProxy < 0 || s.SendProxy > 2 {
+		return fmt.Errorf("invalid proxy protocol version %d", s.SendProxy)
+	}
+	if err := s.SocketOpts.validate(); err != nil {
+		return err
+	}
+	proxyNets, err := parseCIDRs(s.AcceptProxy)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	s.proxyNets = proxyNets
 
 	var certificate tls.Certificate
 	if s.testCert != nil {
@@ -80,7 +259,7 @@ func (s *Server) ActiveAndServe() error {
 				return fmt.Errorf("failed to generate temp cert: %w", err)
 			}
 
-			log.Printf("warnning: you are using a tmp certificate with dns name: %s", dnsName)
+			s.logger.l.Warn("you are using a tmp certificate", zap.String("dns_name", dnsName))
 			cer, err := tls.X509KeyPair(certPEM, keyPEM)
 			if err != nil {
 				return fmt.Errorf("cannot load x509 key pair from memory: %w", err)
@@ -98,7 +277,7 @@ func (s *Server) ActiveAndServe() error {
 		}
 	}
 
-	tlsConfig := &tls.Config{
+	s.tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{certificate},
 		VerifyConnection: func(state tls.ConnectionState) error {
 			if state.Version != tls.VersionTLS13 {
@@ -108,17 +287,49 @@ func (s *Server) ActiveAndServe() error {
 		},
 	}
 
-	outboundHandler := func(dst string) TransportHandler {
+	outboundHandler := func(route, dst string) (TransportHandler, error) {
 		var handler TransportHandler
-		if s.testTransportHandler != nil {
-			handler = s.testTransportHandler
-		} else {
-			handler = NewDstTransportHandler(dst, s.IdleTimeout, s.OutboundBuf)
+		switch {
+		case s.Handler != nil:
+			handler = s.Handler
+		case IsBackendPool(dst):
+			opts := s.BackendOpts
+			if opts.Logger == nil {
+				opts.Logger = s.logger.l
+			}
+			if opts.SocketOpts == nil {
+				opts.SocketOpts = s.SocketOpts
+			}
+			pool, err := NewBackendPool(dst, opts)
+			if err != nil {
+				return nil, err
+			}
+			s.pools = append(s.pools, pool)
+			h := NewPoolTransportHandler(pool, s.IdleTimeout, s.OutboundBuf)
+			h.ProxyProtocol = s.SendProxy
+			handler = h
+		default:
+			h := NewDstTransportHandler(dst, s.IdleTimeout, s.OutboundBuf)
+			h.ProxyProtocol = s.SendProxy
+			h.SocketOpts = s.SocketOpts
+			handler = h
 		}
-		return handler
+		handler = Chain(handler, s.RouteMiddlewares[route]...)
+		handler = Chain(handler, s.Middlewares...)
+		return withRoute(route, handler), nil
 	}
 
 	if s.GRPC {
+		// The route of a grpc conn is unknown before the handshake.
+		// So MaxConnsPerRoute is checked by streams only.
+		lnLimits := s.Limits
+		lnLimits.MaxConnsPerRoute = 0
+		s.lnLimiter = newConnLimiter(lnLimits)
+		streamLimits := s.Limits
+		streamLimits.AcceptRate = 0
+		streamLimits.AcceptBurst = 0
+		streamLimiter := newConnLimiter(streamLimits)
+
 		serverOpts := []grpc.ServerOption{
 			grpc.KeepaliveParams(keepalive.ServerParameters{
 				MaxConnectionIdle: time.Second * 300,
@@ -131,13 +342,26 @@ func (s *Server) ActiveAndServe() error {
 			}),
 			grpc.MaxSendMsgSize(64 * 1024),
 			grpc.MaxRecvMsgSize(64 * 1024),
-			grpc.Creds(credentials.NewTLS(tlsConfig)),
+			grpc.Creds(banCreds{TransportCredentials: credentials.NewTLS(s.tlsConfig), bans: s.BanList}),
 			grpc.InitialWindowSize(1024 * 1024),
 			grpc.InitialConnWindowSize(1024 * 1024),
 			grpc.MaxConcurrentStreams(64), // This limit is larger than the hardcoded client limit.
 			grpc.MaxHeaderListSize(2048),
+			grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+				// Latency probes of clients are not failures.
+				if m, _ := grpc.MethodFromServerStream(stream); m == healthCheckMethod {
+					return status.Error(codes.Unimplemented, "unknown service")
+				}
+				if p, ok := peer.FromContext(stream.Context()); ok {
+					s.BanList.fail(p.Addr, "unknown grpc path")
+				}
+				return status.Error(codes.Unimplemented, "unknown service")
+			}),
 		}
 		grpcServer := grpc.NewServer(serverOpts...)
+		if s.GRPCHealth {
+			healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+		}
 		if d := s.DstAddr; strings.ContainsAny(d, "/,") {
 			pathDstPeers := strings.Split(s.DstAddr, ",")
 			for _, peer := range pathDstPeers {
@@ -145,16 +369,126 @@ func (s *Server) ActiveAndServe() error {
 				if !ok {
 					return fmt.Errorf("invalid dst value [%s]", peer)
 				}
-				log.Printf("starting grpc func at path %s -> %s", path, dst)
-				grpc_tunnel.RegisterGRPCTunnelServerAddon(grpcServer, newGrpcServerHandler(outboundHandler(dst)), path)
+				s.logger.l.Info("starting grpc func", zap.String("path", path), zap.String("dst", dst))
+				h, err := outboundHandler(path, dst)
+				if err != nil {
+					return err
+				}
+				grpc_tunnel.RegisterGRPCTunnelServerAddon(grpcServer, newGrpcServerHandler(h, s.logger, path, streamLimiter), path)
 			}
 		} else {
-			grpc_tunnel.RegisterGRPCTunnelServerAddon(grpcServer, newGrpcServerHandler(outboundHandler(s.DstAddr)), s.GRPCServiceName)
+			h, err := outboundHandler(s.GRPCServiceName, s.DstAddr)
+			if err != nil {
+				return err
+			}
+			grpc_tunnel.RegisterGRPCTunnelServerAddon(grpcServer, newGrpcServerHandler(h, s.logger, s.GRPCServiceName, streamLimiter), s.GRPCServiceName)
 		}
+		s.grpcServer = grpcServer
+		return nil
+	}
+
+	s.lnLimiter = newConnLimiter(s.Limits)
+	s.tlsConfig.GetConfigForClient = probeConfig(s.tlsConfig)
+	h, err := outboundHandler("", s.DstAddr)
+	if err != nil {
+		return err
+	}
+	s.rawHandler = h
+	return nil
+}
+
+// probeConfig returns a tls.Config.GetConfigForClient func that accepts
+// probeALPN if the client offers it. Other clients get c as is.
+func probeConfig(c *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	pc := c.Clone()
+	pc.NextProtos = []string{probeALPN}
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, p := range hello.SupportedProtos {
+			if p == probeALPN {
+				return pc, nil
+			}
+		}
+		return nil, nil
+	}
+}
 
-		return grpcServer.Serve(l)
+// banCreds reports server side handshake failures to bans.
+type banCreds struct {
+	credentials.TransportCredentials
+	bans *BanList
+}
+
+func (c banCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	rc, info, err := c.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		c.bans.handshakeFail(conn.RemoteAddr(), err)
+		return rc, info, err
+	}
+	if tlsInfo, ok := info.(credentials.TLSInfo); ok {
+		info = serverTLSInfo{TLSInfo: tlsInfo, localAddr: conn.LocalAddr()}
 	}
+	return rc, info, nil
+}
+
+// serverTLSInfo is credentials.TLSInfo with the local address of the
+// conn, which grpc does not expose to the stream handlers.
+type serverTLSInfo struct {
+	credentials.TLSInfo
+	localAddr net.Addr
+}
+
+func (i serverTLSInfo) LocalAddr() net.Addr {
+	return i.localAddr
+}
+
+func (c banCreds) Clone() credentials.TransportCredentials {
+	return banCreds{TransportCredentials: c.TransportCredentials.Clone(), bans: c.bans}
+}
 
-	l = tls.NewListener(l, tlsConfig)
-	return ListenRawConn(l, outboundHandler(s.DstAddr))
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections (sends GOAWAY in gRPC mode) and waits for active tunnels
+// to finish. If ctx is done before that, remaining tunnels are force-closed
+// and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lc.close()
+
+	// Make sure that init won't run after Shutdown, so we can safely
+	// access grpcServer.
+	s.initOnce.Do(func() {
+		s.initErr = ErrServerClosed
+	})
+	defer func() {
+		for _, pool := range s.pools {
+			pool.Close()
+		}
+	}()
+	if grpcServer := s.grpcServer; grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			<-stopped
+			return ctx.Err()
+		}
+	}
+
+	err := s.lc.tunnels.wait(ctx)
+	s.lc.tunnels.closeAll()
+	return err
+}
+
+// Close immediately closes the server and all its active tunnels.
+func (s *Server) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
 }
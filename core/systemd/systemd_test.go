@@ -0,0 +1,129 @@
+//go:build linux
+
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_Notify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify(StateReady); ok || err != nil {
+		t.Fatalf("want false and nil, got %v %v", ok, err)
+	}
+
+	// A local unix socket stands in for systemd.
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	for _, state := range [...]string{StateReady, StateWatchdog, StateStopping} {
+		ok, err := Notify(state)
+		if !ok || err != nil {
+			t.Fatalf("want true and nil, got %v %v", ok, err)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 64)
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != state {
+			t.Fatalf("want %s, got %s", state, b[:n])
+		}
+	}
+}
+
+func Test_Listeners(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	if ls, err := Listeners(); ls != nil || err != nil {
+		t.Fatalf("want nil and nil, got %v %v", ls, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd())) // Listeners closes it.
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "test")
+	ls, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 || ls[0].Addr().String() != l.Addr().String() {
+		t.Fatalf("unexpected listeners %v", ls)
+	}
+	defer ls[0].Close()
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Fatal("LISTEN_FDS was not unset")
+	}
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := ls[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func Test_WatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if d, err := WatchdogInterval(); d != 0 || err != nil {
+		t.Fatalf("want 0 and nil, got %v %v", d, err)
+	}
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if d, err := WatchdogInterval(); d != time.Second*3 || err != nil {
+		t.Fatalf("want 3s and nil, got %v %v", d, err)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, err := WatchdogInterval(); d != 0 || err != nil {
+		t.Fatalf("want 0 and nil, got %v %v", d, err)
+	}
+}
@@ -18,11 +18,236 @@
 package core
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// TcpConfig is the socket options of the tcp sockets. It is applied to
+// outbound sockets, and to listeners (inherited by accepted sockets)
+// except AndroidVPN, Interface and SourceAddr.
 type TcpConfig struct {
 	AndroidVPN bool
+
+	// The following options are only supported on linux. Zero values
+	// mean the system defaults.
+
+	// Mark sets SO_MARK for policy routing. It requires CAP_NET_ADMIN.
+	Mark int
+	// Interface binds outbound sockets to an interface (SO_BINDTODEVICE).
+	Interface string
+	// SourceAddr is the local ip of outbound sockets.
+	SourceAddr string
+	// Congestion sets TCP_CONGESTION, e.g. "bbr".
+	Congestion string
+	// UserTimeout sets TCP_USER_TIMEOUT.
+	UserTimeout time.Duration
+	// NotSentLowat sets TCP_NOTSENT_LOWAT in bytes.
+	NotSentLowat int
+	// DSCP sets the DSCP bits of IP_TOS and IPV6_TCLASS, 0~63.
+	DSCP int
+	// KeepAliveIdle, KeepAliveInterval and KeepAliveCount set
+	// TCP_KEEPIDLE, TCP_KEEPINTVL and TCP_KEEPCNT. If any of them is set,
+	// tcp keepalive is enabled and the go default (15s) is not used.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// FastOpen enables tcp fast open, TCP_FASTOPEN on listeners and
+	// TCP_FASTOPEN_CONNECT on outbound sockets. If the kernel does not
+	// support it, it will be ignored. Server side tfo also requires the
+	// sysctl net.ipv4.tcp_fastopen to have the 0x2 bit. Linux only, it is
+	// ignored on other platforms.
+	FastOpen bool
+	// ReusePort sets SO_REUSEPORT on listeners. So multiple listeners,
+	// also from other processes, can listen on the same address, and the
+	// kernel spreads the conns across them. Linux only.
+	ReusePort bool
+
+	listener bool // set by inbound().
+}
+
+var errSockOptUnsupported = errors.New("socket options are only supported on linux")
+
+func (c *TcpConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.SourceAddr) > 0 && net.ParseIP(c.SourceAddr) == nil {
+		return fmt.Errorf("invalid source address [%s]", c.SourceAddr)
+	}
+	if c.DSCP < 0 || c.DSCP > 63 {
+		return fmt.Errorf("invalid dscp %d", c.DSCP)
+	}
+	if c.linuxOptsSet() && runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		return errSockOptUnsupported
+	}
+	return nil
+}
+
+// linuxOptsSet reports whether any linux only option is set.
+func (c *TcpConfig) linuxOptsSet() bool {
+	return c.Mark != 0 || len(c.Interface) > 0 || len(c.Congestion) > 0 || c.UserTimeout > 0 ||
+		c.NotSentLowat > 0 || c.DSCP > 0 || c.keepAliveSet() || c.ReusePort
+}
+
+func (c *TcpConfig) keepAliveSet() bool {
+	return c.KeepAliveIdle > 0 || c.KeepAliveInterval > 0 || c.KeepAliveCount > 0
+}
+
+// inbound returns the options for listeners.
+func (c *TcpConfig) inbound() *TcpConfig {
+	if c == nil {
+		return nil
+	}
+	ic := *c
+	ic.AndroidVPN = false
+	ic.Interface = ""
+	ic.SourceAddr = ""
+	ic.listener = true
+	return &ic
+}
+
+// fastOpenConn counts the conn to n after its first successful Read
+// if tcp fast open was used, which means the data in SYN was acked.
+type fastOpenConn struct {
+	net.Conn
+	n         *uint64
+	checkOnce sync.Once
+}
+
+// wrapFastOpenConn returns c as it is if c is not a tcp conn or tfo is
+// disabled by conf.
+func wrapFastOpenConn(c net.Conn, conf *TcpConfig, n *uint64) net.Conn {
+	if _, ok := c.(*net.TCPConn); !ok || conf == nil || !conf.FastOpen {
+		return c
+	}
+	return &fastOpenConn{Conn: c, n: n}
+}
+
+func (c *fastOpenConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.checkOnce.Do(func() {
+			if fastOpenUsed(c.Conn) {
+				atomic.AddUint64(c.n, 1)
+			}
+		})
+	}
+	return n, err
+}
+
+func (c *fastOpenConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// listenN opens n (at least 1) listeners on addr with SO_REUSEPORT,
+// see listen. If n > 1, SO_REUSEPORT is always set. Unix sockets can
+// only have one listener.
+func listenN(addr string, n int, opts UnixSocketOpts, sockOpts *TcpConfig, logger connLogger) ([]net.Listener, error) {
+	if network, _ := splitAddr(addr); n <= 1 || network == "unix" {
+		l, err := listen(addr, opts, sockOpts, logger)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	rc := new(TcpConfig)
+	if sockOpts != nil {
+		*rc = *sockOpts
+	}
+	rc.ReusePort = true
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := listen(addr, opts, rc, logger)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+		addr = l.Addr().String() // in case that the port is 0.
+	}
+	return ls, nil
+}
+
+// serveListeners calls serve on every listener in ls concurrently.
+// When the first serve returns, all listeners will be closed. It returns
+// the error of the first serve.
+func serveListeners(ls []net.Listener, serve func(l net.Listener) error) error {
+	if len(ls) == 1 {
+		return serve(ls[0])
+	}
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		l := l
+		go func() {
+			errs <- serve(l)
+		}()
+	}
+	err := <-errs
+	for _, l := range ls {
+		l.Close()
+	}
+	for i := 1; i < len(ls); i++ {
+		<-errs
+	}
+	return err
+}
+
+// newFastOpenListener wraps the accepted conns of l by wrapFastOpenConn.
+// It returns l as it is if tfo is disabled by conf.
+func newFastOpenListener(l net.Listener, conf *TcpConfig, n *uint64) net.Listener {
+	if conf == nil || !conf.FastOpen {
+		return l
+	}
+	return &fastOpenListener{Listener: l, conf: conf, n: n}
+}
+
+type fastOpenListener struct {
+	net.Listener
+	conf *TcpConfig
+	n    *uint64
+}
+
+func (l *fastOpenListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return wrapFastOpenConn(c, l.conf, l.n), nil
+}
+
+// newDialer returns a net.Dialer that applies c. c can be nil.
+// c must be validated.
+func (c *TcpConfig) newDialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, Control: GetControlFunc(c)}
+	if c == nil {
+		return d
+	}
+	if len(c.SourceAddr) > 0 {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.SourceAddr)}
+	}
+	if c.keepAliveSet() {
+		d.KeepAlive = -1 // don't override our keepalive options.
+	}
+	return d
+}
+
+// listenConfig returns a net.ListenConfig that applies c.inbound().
+func (c *TcpConfig) listenConfig() *net.ListenConfig {
+	ic := c.inbound()
+	lc := &net.ListenConfig{Control: GetControlFunc(ic)}
+	if ic != nil && ic.keepAliveSet() {
+		lc.KeepAlive = -1
+	}
+	return lc
 }
 
 // applyTCPSocketBuf set tcp socket io buf if c is a *net.TCPConn.
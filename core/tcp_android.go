@@ -30,7 +30,7 @@ import (
 
 func GetControlFunc(conf *TcpConfig) func(network, address string, c syscall.RawConn) error {
 	return func(network, address string, c syscall.RawConn) error {
-		if conf.AndroidVPN {
+		if conf != nil && conf.AndroidVPN {
 			var scmErr error
 			if err := c.Control(func(fd uintptr) {
 				scmErr = sendFdToVPN(fd)
@@ -43,7 +43,13 @@ func GetControlFunc(conf *TcpConfig) func(network, address string, c syscall.Raw
 			}
 		}
 		if conf != nil {
-			return c.Control(conf.setSockOpt)
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = conf.setSockOpt(network, int(fd))
+			}); controlErr != nil {
+				return controlErr
+			}
+			return err
 		} else {
 			return nil
 		}
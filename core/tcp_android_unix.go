@@ -20,6 +20,108 @@
 
 package core
 
-func (c *TcpConfig) setSockOpt(uintFd uintptr) {
-	return
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const tcpiOptSynData = 0x20 // TCPI_OPT_SYN_DATA
+
+// fastOpenUsed reports whether the data in SYN of c was acked.
+func fastOpenUsed(c net.Conn) bool {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var info *unix.TCPInfo
+	rc.Control(func(fd uintptr) {
+		info, _ = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	return info != nil && info.Options&tcpiOptSynData != 0
+}
+
+// setSockOpt applies c to fd. Options are only applied to tcp sockets.
+func (c *TcpConfig) setSockOpt(network string, fd int) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	if c.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, c.Mark); err != nil {
+			return fmt.Errorf("failed to set SO_MARK: %w", err)
+		}
+	}
+	if len(c.Interface) > 0 {
+		if err := unix.BindToDevice(fd, c.Interface); err != nil {
+			return fmt.Errorf("failed to set SO_BINDTODEVICE: %w", err)
+		}
+	}
+	if len(c.Congestion) > 0 {
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, c.Congestion); err != nil {
+			return fmt.Errorf("failed to set TCP_CONGESTION: %w", err)
+		}
+	}
+	if c.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(c.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("failed to set TCP_USER_TIMEOUT: %w", err)
+		}
+	}
+	if c.NotSentLowat > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, c.NotSentLowat); err != nil {
+			return fmt.Errorf("failed to set TCP_NOTSENT_LOWAT: %w", err)
+		}
+	}
+	if c.DSCP > 0 {
+		tos := c.DSCP << 2
+		if network == "tcp6" {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+				return fmt.Errorf("failed to set IPV6_TCLASS: %w", err)
+			}
+			// For the ipv4-mapped traffic of dual stack sockets.
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+			return fmt.Errorf("failed to set IP_TOS: %w", err)
+		}
+	}
+	if c.ReusePort && c.listener {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fmt.Errorf("failed to set SO_REUSEPORT: %w", err)
+		}
+	}
+	if c.FastOpen {
+		// Errors are ignored, tfo is optional.
+		if c.listener {
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, 256)
+		} else {
+			_ = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		}
+	}
+	if c.keepAliveSet() {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+			return fmt.Errorf("failed to set SO_KEEPALIVE: %w", err)
+		}
+		for _, o := range [...]struct {
+			name  string
+			opt   int
+			value int
+		}{
+			{"TCP_KEEPIDLE", unix.TCP_KEEPIDLE, int(c.KeepAliveIdle.Seconds())},
+			{"TCP_KEEPINTVL", unix.TCP_KEEPINTVL, int(c.KeepAliveInterval.Seconds())},
+			{"TCP_KEEPCNT", unix.TCP_KEEPCNT, c.KeepAliveCount},
+		} {
+			if o.value <= 0 {
+				continue
+			}
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, o.opt, o.value); err != nil {
+				return fmt.Errorf("failed to set %s: %w", o.name, err)
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,224 @@
+//go:build linux
+
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_TcpConfig(t *testing.T) {
+	conf := &TcpConfig{
+		UserTimeout:       time.Second * 3,
+		NotSentLowat:      16384,
+		DSCP:              46,
+		KeepAliveIdle:     time.Second * 30,
+		KeepAliveInterval: time.Second * 5,
+		KeepAliveCount:    4,
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listen("127.0.0.1:0", UnixSocketOpts{}, conf, newConnLogger(nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c
+	}()
+
+	c, err := conf.newDialer(time.Second).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac := <-accepted
+	defer ac.Close()
+
+	for _, c := range [...]net.Conn{c, ac} {
+		for _, o := range [...]struct {
+			name       string
+			level, opt int
+			want       int
+		}{
+			{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 3000},
+			{"TCP_NOTSENT_LOWAT", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, 16384},
+			{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, 46 << 2},
+			{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+			{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 30},
+			{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 5},
+			{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 4},
+		} {
+			if got := getsockoptInt(t, c.(syscall.Conn), o.level, o.opt); got != o.want {
+				t.Errorf("%s: want %d, got %d", o.name, o.want, got)
+			}
+		}
+	}
+
+	if err := (&TcpConfig{SourceAddr: "bad"}).validate(); err == nil {
+		t.Error("want an error for an invalid source address")
+	}
+}
+
+func getsockoptInt(t *testing.T, c syscall.Conn, level, opt int) int {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var optErr error
+	rc.Control(func(fd uintptr) {
+		v, optErr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return v
+}
+
+func Test_FastOpen(t *testing.T) {
+	conf := &TcpConfig{FastOpen: true}
+	l, err := listen("127.0.0.1:0", UnixSocketOpts{}, conf, newConnLogger(nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getsockoptInt(t, l.(syscall.Conn), unix.IPPROTO_TCP, unix.TCP_FASTOPEN); got != 256 {
+		t.Fatalf("TCP_FASTOPEN: want 256, got %d", got)
+	}
+
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	cert := newTestCert(t)
+	server := &Server{
+		DstAddr:     echoListener.Addr().String(),
+		IdleTimeout: time.Minute,
+		SocketOpts:  conf,
+		testCert:    &cert,
+	}
+	go server.Serve(context.Background(), l)
+	defer server.Close()
+
+	client := &Client{
+		DstAddr:            l.Addr().String(),
+		InsecureSkipVerify: true,
+		SocketOpts:         conf,
+	}
+	defer client.Close()
+
+	// The first conn gets the tfo cookie, so at least two conns are needed.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		conn, err := client.Dial(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte("hello"))
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both client and server tfo are required by loopback conns.
+	b, _ := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if mode, _ := strconv.Atoi(strings.TrimSpace(string(b))); mode&3 == 3 {
+		if client.FastOpenConns() == 0 || server.FastOpenConns() == 0 {
+			t.Fatalf("tfo was not used, client %d, server %d", client.FastOpenConns(), server.FastOpenConns())
+		}
+	} else {
+		t.Logf("tfo is not fully enabled by the kernel (mode %d), client %d, server %d", mode, client.FastOpenConns(), server.FastOpenConns())
+	}
+}
+
+func Test_ReusePort(t *testing.T) {
+	echoListener := startEchoServer(t)
+	defer echoListener.Close()
+	cert := newTestCert(t)
+	server := &Server{
+		BindAddr:    "127.0.0.1:0",
+		DstAddr:     echoListener.Addr().String(),
+		IdleTimeout: time.Minute,
+		Listeners:   4,
+		testCert:    &cert,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ActiveAndServe()
+	}()
+	select {
+	case <-server.Ready():
+	case err := <-serveErr:
+		t.Fatal(err)
+	}
+	addr := server.Addr().String()
+
+	// Another process can listen on the same address.
+	l, err := listen(addr, UnixSocketOpts{}, &TcpConfig{ReusePort: true}, newConnLogger(nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	client := &Client{DstAddr: addr, InsecureSkipVerify: true}
+	defer client.Close()
+	for i := 0; i < 8; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		conn, err := client.Dial(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte("hello"))
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.Close()
+	select {
+	case err := <-serveErr:
+		if err != ErrServerClosed {
+			t.Fatalf("want ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ActiveAndServe did not return")
+	}
+}
@@ -20,9 +20,19 @@
 package core
 
 import (
+	"net"
 	"syscall"
 )
 
 func GetControlFunc(conf *TcpConfig) func(network, address string, c syscall.RawConn) error {
+	if conf != nil && conf.linuxOptsSet() {
+		return func(network, address string, c syscall.RawConn) error {
+			return errSockOptUnsupported
+		}
+	}
 	return nil
 }
+
+func fastOpenUsed(c net.Conn) bool {
+	return false
+}
@@ -0,0 +1,31 @@
+//go:build !linux && !android
+
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import "testing"
+
+func Test_TcpConfig_unsupported(t *testing.T) {
+	if err := (&TcpConfig{Mark: 1}).validate(); err != errSockOptUnsupported {
+		t.Fatalf("want errSockOptUnsupported, got %v", err)
+	}
+	if err := (&TcpConfig{FastOpen: true}).validate(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -24,7 +24,13 @@ import "syscall"
 func GetControlFunc(conf *TcpConfig) func(network, address string, c syscall.RawConn) error {
 	if conf != nil {
 		return func(network, address string, c syscall.RawConn) error {
-			return c.Control(conf.setSockOpt)
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = conf.setSockOpt(network, int(fd))
+			}); controlErr != nil {
+				return controlErr
+			}
+			return err
 		}
 	}
 
@@ -22,43 +22,202 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/IrineSistiana/simple-tls/core/ctunnel"
-	"github.com/IrineSistiana/simple-tls/core/mlog"
+	"github.com/IrineSistiana/simple-tls/core/proxyproto"
+	"go.uber.org/zap"
 	"net"
 	"time"
 )
 
+// Transport opens tunneled conns. It is implemented by Client.
+// e.g. It can be used as http.Transport.DialContext:
+//
+//	DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+//		return client.Dial(ctx)
+//	}
 type Transport interface {
 	Dial(ctx context.Context) (net.Conn, error)
 }
 
+// TransportHandler handles incoming tunnels of a Server. Handle should
+// block until the tunnel is finished. conn will be closed after Handle returns.
+// ctx carries the route and the logger of the tunnel, see RouteFromContext
+// and LoggerFromContext, and it will be canceled when the tunnel is closed
+// by the server.
+// Middleware can be used to wrap a TransportHandler.
 type TransportHandler interface {
-	Handle(conn net.Conn) error
+	Handle(ctx context.Context, conn net.Conn) error
 }
 
 type DstTransportHandler struct {
 	dst             string
+	pool            *BackendPool // if not nil, dst is not used.
 	idleTimeout     time.Duration
 	outboundBufSize int
+
+	// ProxyProtocol is the version of the PROXY protocol header that will
+	// be sent to the dst before any data. The header carries the remote
+	// address of the incoming conn. v2 headers also carry the SNI, ALPN,
+	// tls version and cipher of the tls conn. 0 means disabled.
+	ProxyProtocol int
+	// SocketOpts is applied to the dst sockets. It must be valid.
+	SocketOpts *TcpConfig
 }
 
-func (h *DstTransportHandler) Handle(conn net.Conn) error {
-	dstConn, err := net.Dial("tcp", h.dst)
+func (h *DstTransportHandler) Handle(ctx context.Context, conn net.Conn) error {
+	var dstConn net.Conn
+	var err error
+	if h.pool != nil {
+		dstConn, err = h.pool.Dial(ctx, remoteIP(conn.RemoteAddr()))
+	} else {
+		d := h.SocketOpts.newDialer(0)
+		network, addr := splitAddr(h.dst)
+		dstConn, err = d.DialContext(ctx, network, addr)
+	}
 	if err != nil {
 		return fmt.Errorf("cannot connect to the dst: %w", err)
 	}
 	defer dstConn.Close()
-	applyTCPSocketBuf(dstConn, h.outboundBufSize)
-	if err := ctunnel.OpenTunnel(dstConn, conn, ctunnel.TunnelOpts{IdleTimout: h.idleTimeout}); err != nil {
+	if bc, ok := dstConn.(*backendConn); ok {
+		applyTCPSocketBuf(bc.Conn, h.outboundBufSize)
+	} else {
+		applyTCPSocketBuf(dstConn, h.outboundBufSize)
+	}
+
+	logger := LoggerFromContext(ctx)
+	logger.Debug("dst connected", zap.Stringer("dst", dstConn.RemoteAddr()))
+	if h.ProxyProtocol > 0 {
+		if _, err := proxyHeader(ctx, conn, h.ProxyProtocol).WriteTo(dstConn); err != nil {
+			return fmt.Errorf("failed to write proxy protocol header: %w", err)
+		}
+	}
+	opts := ctunnel.TunnelOpts{IdleTimout: h.idleTimeout, Logger: logger, Limiter: tunnelLimiterFromContext(ctx)}
+	setTunnelHooks(ctx, &opts)
+	if _, err := ctunnel.OpenTunnel(conn, dstConn, opts); err != nil {
 		return fmt.Errorf("tunnel closed: %w", err)
 	}
 	return nil
 }
 
+// proxyHeader returns the PROXY protocol header of conn.
+func proxyHeader(ctx context.Context, conn net.Conn, version int) *proxyproto.Header {
+	h := &proxyproto.Header{Version: byte(version), Src: conn.RemoteAddr(), Dst: conn.LocalAddr()}
+	if st := tlsStateFromContext(ctx); st != nil && version == 2 {
+		h.TLVs = tlsTLVs(st)
+	}
+	return h
+}
+
+func tlsTLVs(st *tls.ConnectionState) []proxyproto.TLV {
+	var tlvs []proxyproto.TLV
+	if len(st.NegotiatedProtocol) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeALPN, Value: []byte(st.NegotiatedProtocol)})
+	}
+	if len(st.ServerName) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(st.ServerName)})
+	}
+
+	// The server does not request client certificates, so the SSL TLV
+	// never carries a client certificate or its CN.
+	return append(tlvs, proxyproto.SSLTLV(proxyproto.ClientSSL, true,
+		proxyproto.TLV{Type: proxyproto.SubtypeSSLVersion, Value: []byte(tlsVersionName(st.Version))},
+		proxyproto.TLV{Type: proxyproto.SubtypeSSLCipher, Value: []byte(tls.CipherSuiteName(st.CipherSuite))},
+	))
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+type tlsStateCtxKey struct{}
+
+// withTLSState returns a copy of ctx that carries the tls state of
+// the incoming conn.
+func withTLSState(ctx context.Context, st tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, tlsStateCtxKey{}, &st)
+}
+
+func tlsStateFromContext(ctx context.Context) *tls.ConnectionState {
+	st, _ := ctx.Value(tlsStateCtxKey{}).(*tls.ConnectionState)
+	return st
+}
+
+type tunnelHooksCtxKey struct{}
+
+// TunnelHooks are the callbacks of the tunnel that will be opened by
+// DstTransportHandler, see ctunnel.TunnelOpts. In that tunnel, a is the
+// incoming conn and b is the dst conn. So ctunnel.AToB is the upload
+// direction. Middlewares can use them to collect tunnel statistics.
+type TunnelHooks struct {
+	OnStart func()
+	OnBytes func(d ctunnel.Direction, n int64)
+	OnClose func(r ctunnel.Result)
+}
+
+// WithTunnelHooks returns a copy of ctx that carries h. Hooks that were
+// already in ctx will also be called.
+func WithTunnelHooks(ctx context.Context, h TunnelHooks) context.Context {
+	hs, _ := ctx.Value(tunnelHooksCtxKey{}).([]TunnelHooks)
+	hs = append(hs[:len(hs):len(hs)], h)
+	return context.WithValue(ctx, tunnelHooksCtxKey{}, hs)
+}
+
+// setTunnelHooks sets the hooks in ctx to opts.
+func setTunnelHooks(ctx context.Context, opts *ctunnel.TunnelOpts) {
+	hs, _ := ctx.Value(tunnelHooksCtxKey{}).([]TunnelHooks)
+	if len(hs) == 0 {
+		return
+	}
+	opts.OnStart = func() {
+		for _, h := range hs {
+			if h.OnStart != nil {
+				h.OnStart()
+			}
+		}
+	}
+	opts.OnBytes = func(d ctunnel.Direction, n int64) {
+		for _, h := range hs {
+			if h.OnBytes != nil {
+				h.OnBytes(d, n)
+			}
+		}
+	}
+	opts.OnClose = func(r ctunnel.Result) {
+		for _, h := range hs {
+			if h.OnClose != nil {
+				h.OnClose(r)
+			}
+		}
+	}
+}
+
 func NewDstTransportHandler(dst string, idleTimeout time.Duration, outboundBufSize int) *DstTransportHandler {
 	return &DstTransportHandler{dst: dst, idleTimeout: idleTimeout, outboundBufSize: outboundBufSize}
 }
 
+// NewPoolTransportHandler returns a DstTransportHandler that forwards
+// tunnels to the backends in pool.
+func NewPoolTransportHandler(pool *BackendPool, idleTimeout time.Duration, outboundBufSize int) *DstTransportHandler {
+	return &DstTransportHandler{pool: pool, idleTimeout: idleTimeout, outboundBufSize: outboundBufSize}
+}
+
 func ListenRawConn(l net.Listener, nextHandler TransportHandler) error {
+	return listenRawConn(l, nextHandler, new(connGroup), newConnLogger(nil, ""), nil)
+}
+
+// listenRawConn is ListenRawConn but tracks all accepted conns in g,
+// logs to cl, and reports tls handshake failures to bans (can be nil).
+func listenRawConn(l net.Listener, nextHandler TransportHandler, g *connGroup, cl connLogger, bans *BanList) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -66,19 +225,35 @@ func ListenRawConn(l net.Listener, nextHandler TransportHandler) error {
 		}
 		go func() {
 			defer conn.Close()
+			cl := cl.forConn(conn)
+			ctx, cancel := context.WithCancel(withConnLogger(context.Background(), cl))
+			defer cancel()
+			if !g.add(conn, cancel) {
+				return
+			}
+			defer g.remove(conn)
 
+			cl.l.Debug("new conn")
 			if tlsConn, ok := conn.(*tls.Conn); ok {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-				err := tlsConn.HandshakeContext(ctx)
-				cancel()
+				hsCtx, hsCancel := context.WithTimeout(ctx, time.Second*3)
+				err := tlsConn.HandshakeContext(hsCtx)
+				hsCancel()
 				if err != nil {
-					mlog.LogConnErr("failed to tls handshake", conn, err)
+					cl.logConnErr("failed to tls handshake", err)
+					bans.handshakeFail(conn.RemoteAddr(), err)
+					return
+				}
+				if tlsConn.ConnectionState().NegotiatedProtocol == probeALPN {
+					cl.l.Debug("probe")
 					return
 				}
 			}
-			err := nextHandler.Handle(conn)
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				ctx = withTLSState(ctx, tlsConn.ConnectionState())
+			}
+			err := nextHandler.Handle(ctx, conn)
 			if err != nil {
-				mlog.LogConnErr("handler err", conn, err)
+				cl.logConnErr("handler err", err)
 			}
 		}()
 	}
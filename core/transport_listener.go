@@ -0,0 +1,120 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// TransportListener is a TransportHandler and a net.Listener.
+// Conns handled by it (decrypted tunnels from a Server, both raw tls and
+// grpc streams) are returned by its Accept. So in-process servers can
+// serve tunnels directly, e.g.
+//
+//	l := NewTransportListener()
+//	s := &Server{Handler: l, ...}
+//	go s.ActiveAndServe()
+//	http.Serve(l, nil)
+type TransportListener struct {
+	connChan chan net.Conn
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+var _ TransportHandler = (*TransportListener)(nil)
+var _ net.Listener = (*TransportListener)(nil)
+
+func NewTransportListener() *TransportListener {
+	return &TransportListener{
+		connChan:    make(chan net.Conn),
+		closeNotify: make(chan struct{}),
+	}
+}
+
+// Handle sends conn to Accept and blocks until the accepted conn is closed
+// or ctx is done. If l was closed before conn was accepted, Handle returns
+// net.ErrClosed.
+func (l *TransportListener) Handle(ctx context.Context, conn net.Conn) error {
+	c := &notifyCloseConn{Conn: conn, closeNotify: make(chan struct{})}
+	select {
+	case l.connChan <- c:
+	case <-l.closeNotify:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-c.closeNotify:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *TransportListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connChan:
+		return c, nil
+	case <-l.closeNotify:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Accepted conns won't be closed.
+func (l *TransportListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeNotify)
+	})
+	return nil
+}
+
+func (l *TransportListener) Addr() net.Addr {
+	return transportListenerAddr{}
+}
+
+type transportListenerAddr struct{}
+
+func (transportListenerAddr) Network() string {
+	return "simple-tls"
+}
+
+func (transportListenerAddr) String() string {
+	return "transport-listener"
+}
+
+// notifyCloseConn closes closeNotify when Close is called.
+type notifyCloseConn struct {
+	net.Conn
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closeNotify)
+	})
+	return err
+}
+
+func (c *notifyCloseConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,270 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const unixAddrPrefix = "unix:"
+
+// splitAddr returns the network and the address of addr. addr can be
+// a tcp address "host:port", a unix socket "unix:/path" or an abstract
+// unix socket "unix:@name" (linux only).
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+// UnixSocketOpts are the options of unix socket listeners.
+type UnixSocketOpts struct {
+	// Mode is the file mode of the socket. 0 means default (umask).
+	Mode os.FileMode
+	// Owner is the owner of the socket, "user[:group]". Names and numeric
+	// ids are both accepted. Empty means unchanged.
+	Owner string
+	// AllowUIDs, if not empty, rejects peers whose uids (SO_PEERCRED)
+	// are not in the list. It is only supported on linux.
+	AllowUIDs []uint32
+}
+
+var errPeerCredUnsupported = errors.New("SO_PEERCRED is not supported on this platform")
+
+// listen listens on addr, see splitAddr. If addr is a unix socket, opts
+// will be applied and a stale socket file will be removed. Otherwise,
+// sockOpts (can be nil) will be applied.
+func listen(addr string, opts UnixSocketOpts, sockOpts *TcpConfig, logger connLogger) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network != "unix" {
+		return sockOpts.listenConfig().Listen(context.Background(), network, address)
+	}
+	if len(opts.AllowUIDs) > 0 && !peerCredSupported {
+		return nil, errPeerCredUnsupported
+	}
+
+	if strings.HasPrefix(address, "@") { // abstract
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return wrapPeerCred(l, opts, logger), nil
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	l, err := listenUnixFile(address, opts)
+	if err != nil {
+		return nil, err
+	}
+	return wrapPeerCred(l, opts, logger), nil
+}
+
+// listenUnixFile listens on the socket file path. The socket is bound in
+// a private temp dir next to path and renamed to path after its owner and
+// mode were set. So no one else can connect to it before that.
+func listenUnixFile(path string, opts UnixSocketOpts) (net.Listener, error) {
+	if runtime.GOOS == "windows" { // no unix permissions
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := setSocketFileOpts(path, opts); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".stls")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := setSocketFileOpts(tmpPath, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixFileListener{UnixListener: l, path: path}, nil
+}
+
+// unixFileListener is a unix listener whose socket file was renamed to path.
+type unixFileListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+}
+
+func (l *unixFileListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixFileListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() { _ = os.Remove(l.path) })
+	return err
+}
+
+// wrapPeerCred wraps l with a peerCredListener if opts.AllowUIDs is set.
+func wrapPeerCred(l net.Listener, opts UnixSocketOpts, logger connLogger) net.Listener {
+	if len(opts.AllowUIDs) > 0 {
+		return &peerCredListener{Listener: l, allow: opts.AllowUIDs, logger: logger}
+	}
+	return l
+}
+
+// activatedListeners applies opts.AllowUIDs to the unix listeners in ls.
+// Other opts are up to the one who created the listeners.
+func activatedListeners(ls []net.Listener, opts UnixSocketOpts, logger connLogger) ([]net.Listener, error) {
+	if len(opts.AllowUIDs) == 0 {
+		return ls, nil
+	}
+	wrapped := make([]net.Listener, 0, len(ls))
+	for _, l := range ls {
+		if _, ok := l.(*net.UnixListener); ok {
+			if !peerCredSupported {
+				return nil, errPeerCredUnsupported
+			}
+			l = &peerCredListener{Listener: l, allow: opts.AllowUIDs, logger: logger}
+		}
+		wrapped = append(wrapped, l)
+	}
+	return wrapped, nil
+}
+
+// removeStaleSocket removes the socket file at path if no one is
+// listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil // let net.Listen report the error.
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func setSocketFileOpts(path string, opts UnixSocketOpts) error {
+	if len(opts.Owner) > 0 {
+		uid, gid, err := lookupOwner(opts.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupOwner parses "user[:group]". gid is -1 if group is omitted.
+func lookupOwner(s string) (uid, gid int, err error) {
+	userStr, groupStr, hasGroup := strings.Cut(s, ":")
+	uid, err = strconv.Atoi(userStr)
+	if err != nil {
+		u, err := user.Lookup(userStr)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("invalid uid [%s]", u.Uid)
+		}
+	}
+	if !hasGroup {
+		return uid, -1, nil
+	}
+	gid, err = strconv.Atoi(groupStr)
+	if err != nil {
+		g, err := user.LookupGroup(groupStr)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("invalid gid [%s]", g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// peerCredListener closes the accepted unix conns whose peer uids are
+// not allowed.
+type peerCredListener struct {
+	net.Listener
+	allow  []uint32
+	logger connLogger
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uc, ok := c.(*net.UnixConn)
+		if !ok {
+			return c, nil
+		}
+		uid, err := peerUID(uc)
+		if err == nil && l.allowed(uid) {
+			return c, nil
+		}
+		l.logger.errLog.Warn("unix conn rejected", zap.Uint32("uid", uid), zap.Error(err))
+		_ = c.Close()
+	}
+}
+
+func (l *peerCredListener) allowed(uid uint32) bool {
+	for _, u := range l.allow {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
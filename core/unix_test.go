@@ -0,0 +1,180 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_UnixSocket(t *testing.T) {
+	if !peerCredSupported {
+		t.Skip(errPeerCredUnsupported)
+	}
+	dir := t.TempDir()
+	cert := newTestCert(t)
+
+	echoListener, err := net.Listen("unix", filepath.Join(dir, "echo.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go serveEcho(echoListener)
+
+	// A stale socket file should be removed.
+	serverSock := filepath.Join(dir, "server.sock")
+	stale, err := net.Listen("unix", serverSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := &Server{
+		BindAddr:    "unix:" + serverSock,
+		DstAddr:     "unix:" + echoListener.Addr().String(),
+		IdleTimeout: time.Minute,
+		testCert:    &cert,
+	}
+	go server.ActiveAndServe()
+	defer server.Close()
+	select {
+	case <-server.Ready():
+	case <-time.After(time.Second * 5):
+		t.Fatal("server is not ready")
+	}
+	// Without UnixSocket.Mode, the socket file has the same mode as
+	// the ones from net.Listen. No temp file is left.
+	refListener, err := net.Listen("unix", filepath.Join(dir, "ref.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refFi, err := os.Stat(refListener.Addr().String())
+	refListener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(serverSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != refFi.Mode() {
+		t.Fatalf("want mode %v, got %v", refFi.Mode(), fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("want 2 files in %s, got %d", dir, len(entries))
+	}
+	if server.Addr().String() != serverSock {
+		t.Fatalf("want addr %s, got %s", serverSock, server.Addr())
+	}
+
+	conn, err := tls.Dial("unix", serverSock, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The client connects to a tcp server.
+	tcpServer := &Server{
+		DstAddr:     "unix:" + echoListener.Addr().String(),
+		IdleTimeout: time.Minute,
+		testCert:    &cert,
+	}
+	serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tcpServer.Serve(context.Background(), serverListener)
+	defer tcpServer.Close()
+
+	uid := uint32(os.Getuid())
+	test := func(t *testing.T, allowed, activated bool) {
+		clientSock := filepath.Join(dir, "client.sock")
+		client := &Client{
+			BindAddr:           "unix:" + clientSock,
+			DstAddr:            serverListener.Addr().String(),
+			InsecureSkipVerify: true,
+			UnixSocket:         UnixSocketOpts{Mode: 0600, AllowUIDs: []uint32{uid}},
+		}
+		if !allowed {
+			client.UnixSocket.AllowUIDs = []uint32{uid + 1}
+		}
+		if activated {
+			l, err := net.Listen("unix", clientSock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.ActivatedListeners = []net.Listener{l}
+		}
+		go client.ActiveAndServe()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			client.Shutdown(ctx)
+			cancel()
+		}()
+		select {
+		case <-client.Ready():
+		case <-time.After(time.Second * 5):
+			t.Fatal("client is not ready")
+		}
+
+		if !activated {
+			fi, err := os.Stat(clientSock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Fatalf("want mode 0600, got %v", fi.Mode().Perm())
+			}
+		}
+
+		conn, err := net.Dial("unix", clientSock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte("hello"))
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		conn.Close()
+		if allowed && err != nil {
+			t.Fatal(err)
+		}
+		if !allowed && err == nil {
+			t.Fatal("conn from a denied uid was accepted")
+		}
+	}
+	for _, activated := range [...]bool{false, true} {
+		for _, allowed := range [...]bool{true, false} {
+			t.Run(fmt.Sprintf("activated_%v_allowed_%v", activated, allowed), func(t *testing.T) {
+				test(t, allowed, activated)
+			})
+		}
+	}
+}
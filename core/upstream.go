@@ -0,0 +1,224 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of simple-tls.
+//
+//     simple-tls is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     simple-tls is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/simple-tls/core/grpc_lb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream is a server of a Client.
+type Upstream struct {
+	Addr               string
+	ServerName         string
+	CA                 string
+	CertHash           string
+	InsecureSkipVerify bool
+	GRPC               bool
+	GRPCServiceName    string
+}
+
+// ParseUpstreams parses a comma separated server list. Every server is
+// "host:port[?options]". Options are url query encoded, and override
+// the values of def:
+//
+//	n: server name
+//	ca: ca file
+//	cert-hash: server certificate hash
+//	no-verify: true/false, skip the certificate verification
+//	grpc: true/false, use grpc
+//	grpc-path: grpc service name
+//
+// e.g. "a.com:443?grpc=true,b.com:443?n=b.cdn.com&cert-hash=8910fe28"
+func ParseUpstreams(s string, def Upstream) ([]Upstream, error) {
+	var ups []Upstream
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if len(e) == 0 {
+			continue
+		}
+		u := def
+		addr, rawQuery, _ := strings.Cut(e, "?")
+		u.Addr = addr
+		q, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid options of server [%s]: %w", e, err)
+		}
+		for k := range q {
+			v := q.Get(k)
+			switch k {
+			case "n":
+				u.ServerName = v
+			case "ca":
+				u.CA = v
+			case "cert-hash":
+				u.CertHash = v
+			case "grpc-path":
+				u.GRPCServiceName = v
+			case "no-verify", "grpc":
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid option %s of server [%s]: %w", k, e, err)
+				}
+				if k == "grpc" {
+					u.GRPC = b
+				} else {
+					u.InsecureSkipVerify = b
+				}
+			default:
+				return nil, fmt.Errorf("unknown option %s of server [%s]", k, e)
+			}
+		}
+		ups = append(ups, u)
+	}
+	if len(ups) == 0 {
+		return nil, fmt.Errorf("no server in [%s]", s)
+	}
+	return ups, nil
+}
+
+const (
+	upstreamMinBackoff  = time.Second
+	upstreamMaxBackoff  = time.Minute
+	upstreamDialTimeout = time.Second * 3 // per server, if there are multiple servers.
+)
+
+// upstream is an Upstream with its dialer and health status.
+type upstream struct {
+	Upstream
+	dial     func(ctx context.Context) (net.Conn, error)
+	probe    func(ctx context.Context) error
+	connPool *grpc_lb.ConnPool // nil if not in grpc mode.
+	probeCc  *grpc.ClientConn  // for grpc health probes, lazily dialed.
+
+	m        sync.Mutex
+	failures int       // consecutive dial failures.
+	retryAt  time.Time // unhealthy until retryAt.
+	probed   bool
+	srtt     time.Duration // smoothed probe RTT.
+	loss     float64       // smoothed probe loss rate.
+	probeErr error         // the last probe error.
+	closed   bool
+}
+
+func (u *upstream) close() {
+	if u.connPool != nil {
+		u.connPool.Close()
+	}
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.closed = true
+	if u.probeCc != nil {
+		_ = u.probeCc.Close()
+	}
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+	return !now.Before(u.retryAt)
+}
+
+// markFailed marks u as unhealthy with an exponential backoff.
+func (u *upstream) markFailed() time.Duration {
+	u.m.Lock()
+	defer u.m.Unlock()
+	backoff := upstreamMaxBackoff
+	if u.failures < 16 {
+		if b := upstreamMinBackoff << u.failures; b < backoff {
+			backoff = b
+		}
+	}
+	u.failures++
+	u.retryAt = time.Now().Add(backoff)
+	return backoff
+}
+
+// markOK marks u as healthy. It returns true if u was unhealthy.
+func (u *upstream) markOK() bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+	recovered := u.failures > 0
+	u.failures = 0
+	u.retryAt = time.Time{}
+	return recovered
+}
+
+// dialUpstreams dials the first healthy upstream in order. If a dial
+// fails, the next one will be tried. Unhealthy upstreams are tried last.
+func (c *Client) dialUpstreams(ctx context.Context) (net.Conn, error) {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(c.upstreams))
+	for _, u := range c.upstreams {
+		if u.healthy(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	for _, u := range c.upstreams {
+		if !u.healthy(now) {
+			candidates = append(candidates, u)
+		}
+	}
+
+	// The selected server goes first.
+	c.selectM.Lock()
+	selected := c.selected
+	c.selectM.Unlock()
+	if selected != nil && selected.healthy(now) {
+		for i, u := range candidates {
+			if u == selected {
+				copy(candidates[1:i+1], candidates[:i])
+				candidates[0] = selected
+				break
+			}
+		}
+	}
+
+	var lastErr error
+	for _, u := range candidates {
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if len(c.upstreams) > 1 {
+			// Leave time for the others.
+			dialCtx, cancel = context.WithTimeout(ctx, upstreamDialTimeout)
+		}
+		conn, err := u.dial(dialCtx)
+		cancel()
+		if err == nil {
+			if u.markOK() {
+				c.logger.l.Info("server recovered", zap.String("server", u.Addr))
+			}
+			return conn, nil
+		}
+		lastErr = err
+		backoff := u.markFailed()
+		c.logger.errLog.Warn("failed to dial server", zap.String("server", u.Addr), zap.Duration("backoff", backoff), zap.Error(err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
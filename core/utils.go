@@ -26,14 +26,23 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"github.com/IrineSistiana/simple-tls/core/mlog"
 	"math/big"
 	mathRand "math/rand"
+	"net"
 	"os"
 	"time"
 )
 
-var logger = mlog.L()
+var errCloseWriteUnsupported = errors.New("conn does not support CloseWrite")
+
+// closeWrite shuts down the writing side of c if c supports it.
+// Wrappers of net.Conn should use it to forward CloseWrite.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
 
 func GenerateCertificate(serverName string, template *x509.Certificate) (dnsName string, cert *x509.Certificate, keyPEM, certPEM []byte, err error) {
 	//priv key